@@ -1,9 +1,23 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	"github.com/boran14cb/chat_server/internal"
 )
 
 func main() {
-	internal.RunServer()
+	// Settings come from the flags, the CHAT_ environment variables and the config file, see -h
+	settings, err := internal.LoadServerSettings(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	internal.RunServer(settings)
 }
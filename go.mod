@@ -2,11 +2,16 @@ module github.com/boran14cb/chat_server
 
 go 1.19
 
-require github.com/fatih/color v1.13.0
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/fatih/color v1.13.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/text v0.14.0
+)
 
 require (
 	github.com/mattn/go-colorable v0.1.9 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/purnaresa/bulwark v0.0.0-20201001150757-1cec324746b2
-	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+	golang.org/x/sys v0.15.0 // indirect
 )
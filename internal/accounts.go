@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Length limits for passwords. bcrypt only uses the first 72 bytes, so longer passwords are refused
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// Errors returned by the account store
+var (
+	errAccountExists = errors.New("an account with that name already exists")
+	errBadLogin      = errors.New("wrong username or password")
+)
+
+// A registered user. Only the bcrypt hash of the password is kept
+type account struct {
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"password_hash"`
+	Created      time.Time `json:"created"`
+}
+
+// Registered accounts keyed by nameKey, saved to a JSON file after every change
+// With an empty path the accounts only live as long as the server
+type accountStore struct {
+	mu       sync.Mutex
+	path     string
+	accounts map[string]account
+}
+
+// Loads the accounts from the file. A missing file is an empty store
+func loadAccounts(path string) (*accountStore, error) {
+	store := &accountStore{path: path, accounts: make(map[string]account)}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []account
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, a := range list {
+		store.accounts[nameKey(a.Name)] = a
+	}
+	return store, nil
+}
+
+// Checks whether an account with the name exists
+func (a *accountStore) exists(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.accounts[nameKey(name)]
+	return ok
+}
+
+// Returns the name of the account as it was registered, or an empty string if there is no such account
+func (a *accountStore) registeredName(name string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.accounts[nameKey(name)].Name
+}
+
+// Creates an account with the name and password and saves the store
+func (a *accountStore) register(name string, password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := nameKey(name)
+	if _, ok := a.accounts[key]; ok {
+		return errAccountExists
+	}
+	a.accounts[key] = account{Name: name, PasswordHash: string(hash), Created: time.Now().UTC()}
+
+	if err := a.save(); err != nil {
+		delete(a.accounts, key)
+		return err
+	}
+	return nil
+}
+
+// Checks the password of an account and returns the account name as it was registered
+func (a *accountStore) authenticate(name string, password string) (string, error) {
+	a.mu.Lock()
+	acc, ok := a.accounts[nameKey(name)]
+	a.mu.Unlock()
+
+	if !ok {
+		// Hashes anyway so a missing account takes as long as a wrong password
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return "", errBadLogin
+	}
+	if bcrypt.CompareHashAndPassword([]byte(acc.PasswordHash), []byte(password)) != nil {
+		return "", errBadLogin
+	}
+	return acc.Name, nil
+}
+
+// Saves the accounts again, used on shutdown
+func (a *accountStore) flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.save()
+}
+
+// Writes every account to the file. The file is replaced in one step so a crash never leaves half of it
+// Called with the lock held
+func (a *accountStore) save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	list := make([]account, 0, len(a.accounts))
+	for _, acc := range a.accounts {
+		list = append(list, acc)
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.path, data)
+}
+
+var (
+	dummyHashOnce  sync.Once
+	dummyHashValue []byte
+)
+
+// Returns a hash that no password matches, made on first use since hashing is slow on purpose
+func dummyHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHashValue, _ = bcrypt.GenerateFromPassword([]byte("no account has this password"), bcrypt.DefaultCost)
+	})
+	return dummyHashValue
+}
+
+// Checks the length of a new password
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("password must be at least 8 characters")
+	}
+	if len(password) > maxPasswordLength {
+		return errors.New("password can be at most 72 bytes")
+	}
+	return nil
+}
+
+// Writes the data to a temporary file next to the path and renames it over the path
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A user banned from a room. The ban matches the identity of the user, the account for logged in users and
+// the guest id otherwise, and the IP address of the user when the server bans by IP. The name is only shown
+type ban struct {
+	Room     string     `json:"room"`
+	Identity string     `json:"identity,omitempty"`
+	Name     string     `json:"name"`
+	IP       string     `json:"ip,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+	By       string     `json:"by"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"` // nil for bans that do not expire
+}
+
+// Room bans, saved to a JSON file after every change so they outlive the server
+// With an empty path the bans only live as long as the server
+type banStore struct {
+	mu   sync.Mutex
+	path string
+	bans []ban
+}
+
+// Loads the bans from the file, leaving out the ones that expired while the server was down. A missing file is an empty store
+func loadBans(path string) (*banStore, error) {
+	store := &banStore{path: path}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &store.bans); err != nil {
+		return nil, err
+	}
+	store.prune()
+	store.forgetGuests()
+	return store, nil
+}
+
+// Guest ids start over with the server, so the bans of guests only keep their IP address after a restart
+// Guest bans without an IP address are dropped
+func (s *banStore) forgetGuests() {
+	kept := make([]ban, 0, len(s.bans))
+	for _, b := range s.bans {
+		if !strings.HasPrefix(b.Identity, accountIdentity("")) {
+			if b.IP == "" {
+				continue
+			}
+			b.Identity = ""
+		}
+		kept = append(kept, b)
+	}
+	s.bans = kept
+}
+
+// Checks whether the ban has run out
+func (b ban) expired() bool {
+	return b.Expires != nil && !time.Now().Before(*b.Expires)
+}
+
+// Checks whether the ban is for the user with the identity and IP address
+func (b ban) matches(identity string, ip string) bool {
+	return (b.Identity != "" && b.Identity == identity) || (b.IP != "" && b.IP == ip)
+}
+
+// Adds the ban, replacing an earlier ban of the same identity in the room, and saves the store
+func (s *banStore) add(b ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+	kept := make([]ban, 0, len(s.bans))
+	for _, old := range s.bans {
+		if old.Room != b.Room || old.Identity != b.Identity {
+			kept = append(kept, old)
+		}
+	}
+	s.bans = append(kept, b)
+	return s.save()
+}
+
+// Lifts the ban and saves the store. Returns false if the ban was lifted already
+// A ban is told apart by its identity, or by its IP address and creation time for guest bans kept over a restart
+func (s *banStore) remove(lifted ban) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+	found := false
+	kept := make([]ban, 0, len(s.bans))
+	for _, b := range s.bans {
+		if b.Room == lifted.Room && b.Identity == lifted.Identity && b.IP == lifted.IP && b.Created.Equal(lifted.Created) {
+			found = true
+			continue
+		}
+		kept = append(kept, b)
+	}
+	if !found {
+		return false, nil
+	}
+	s.bans = kept
+	return true, s.save()
+}
+
+// Returns the ban keeping the user with the identity and IP address out of the room
+func (s *banStore) find(roomName string, identity string, ip string) (ban, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, b := range s.bans {
+		if b.Room == roomName && !b.expired() && b.matches(identity, ip) {
+			return b, true
+		}
+	}
+	return ban{}, false
+}
+
+// Returns the bans of the room that have not expired, sorted by name
+func (s *banStore) list(roomName string) []ban {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []ban
+	for _, b := range s.bans {
+		if b.Room == roomName && !b.expired() {
+			list = append(list, b)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return nameKey(list[i].Name) < nameKey(list[j].Name) })
+	return list
+}
+
+// Moves the bans of a room to its new name and saves the store
+func (s *banStore) renameRoom(oldName string, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for i := range s.bans {
+		if s.bans[i].Room == oldName {
+			s.bans[i].Room = newName
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+// Drops the bans of a deleted room and saves the store
+func (s *banStore) deleteRoom(roomName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := make([]ban, 0, len(s.bans))
+	for _, b := range s.bans {
+		if b.Room != roomName {
+			kept = append(kept, b)
+		}
+	}
+	if len(kept) == len(s.bans) {
+		return nil
+	}
+	s.bans = kept
+	return s.save()
+}
+
+// Saves the bans again, used on shutdown
+func (s *banStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+	return s.save()
+}
+
+// Drops the bans that expired. Called with the lock held
+func (s *banStore) prune() {
+	kept := make([]ban, 0, len(s.bans))
+	for _, b := range s.bans {
+		if !b.expired() {
+			kept = append(kept, b)
+		}
+	}
+	s.bans = kept
+}
+
+// Writes every ban to the file, replacing it in one step. Called with the lock held
+func (s *banStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// Parses the length of a ban or a mute, a Go duration such as 90m or 2h30m, or a number of days such as 7d
+func parseDuration(text string) (time.Duration, bool) {
+	if strings.HasSuffix(text, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(text, "d"))
+		if err != nil || n <= 0 {
+			return 0, false
+		}
+		return time.Duration(n) * 24 * time.Hour, true
+	}
+
+	d, err := time.ParseDuration(text)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// Returns the IP address of the other end of the connection
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
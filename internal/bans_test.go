@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBansSurviveReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+
+	store, err := loadBans(path)
+	if err != nil {
+		t.Fatalf("loadBans without a file: %v", err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	bans := []ban{
+		{Room: "lobby", Identity: accountIdentity("bob"), Name: "bob", By: "admin", Created: time.Now().UTC()},
+		{Room: "lobby", Identity: accountIdentity("eve"), Name: "eve", By: "admin", Created: time.Now().UTC(), Expires: &future},
+		{Room: "games", Identity: "guest:7", Name: "troll", IP: "10.0.0.7", By: "admin", Created: time.Now().UTC()},
+		{Room: "games", Identity: "guest:8", Name: "drifter", By: "admin", Created: time.Now().UTC()},
+	}
+	for _, b := range bans {
+		if err := store.add(b); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	// Written straight into the store, as if it ran out while the server was down
+	store.bans = append(store.bans, ban{Room: "lobby", Identity: accountIdentity("mallory"), Name: "mallory", Created: past, Expires: &past})
+	if err := store.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	reloaded, err := loadBans(path)
+	if err != nil {
+		t.Fatalf("loadBans: %v", err)
+	}
+	if _, banned := reloaded.find("lobby", accountIdentity("bob"), ""); !banned {
+		t.Error("the permanent ban of an account was lost")
+	}
+	if b, banned := reloaded.find("lobby", accountIdentity("eve"), ""); !banned || b.Expires == nil || !b.Expires.Equal(future) {
+		t.Errorf("the timed ban of an account was not kept as it was: %+v", b)
+	}
+	if _, banned := reloaded.find("lobby", accountIdentity("mallory"), ""); banned {
+		t.Error("an expired ban was loaded")
+	}
+
+	// Guest ids start over, only the IP address of a guest ban carries over
+	if _, banned := reloaded.find("games", "guest:7", ""); banned {
+		t.Error("a guest ban still matches the guest id after a restart")
+	}
+	if _, banned := reloaded.find("games", "guest:1", "10.0.0.7"); !banned {
+		t.Error("a guest ban lost its IP address")
+	}
+	if _, banned := reloaded.find("games", "guest:8", ""); banned || len(reloaded.list("games")) != 1 {
+		t.Error("a guest ban without an IP address was kept")
+	}
+
+	// The guest ban has no identity left but can still be lifted
+	if found, err := reloaded.remove(reloaded.list("games")[0]); !found || err != nil {
+		t.Fatalf("remove of a guest ban kept over a restart = %v, %v", found, err)
+	}
+	if _, banned := reloaded.find("games", "guest:1", "10.0.0.7"); banned {
+		t.Error("the guest ban was not lifted")
+	}
+}
+
+func TestBansMatchIdentityNotName(t *testing.T) {
+	store, _ := loadBans("")
+	store.add(ban{Room: "lobby", Identity: "guest:3", Name: "bob", Created: time.Now()})
+
+	if _, banned := store.find("lobby", "guest:3", ""); !banned {
+		t.Fatal("the banned guest is not banned")
+	}
+	if _, banned := store.find("lobby", "guest:4", ""); banned {
+		t.Fatal("another guest is banned")
+	}
+	if found, _ := store.remove(ban{Room: "lobby", Identity: "guest:4", Name: "bob"}); found {
+		t.Fatal("remove lifted the ban of another guest with the same name")
+	}
+	b, _ := store.find("lobby", "guest:3", "")
+	if found, _ := store.remove(b); !found {
+		t.Fatal("remove did not find the ban")
+	}
+}
+
+func TestBansFollowRoomRenameAndDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	store, _ := loadBans(path)
+	store.add(ban{Room: "lobby", Identity: accountIdentity("bob"), Name: "bob", Created: time.Now()})
+	store.add(ban{Room: "games", Identity: accountIdentity("bob"), Name: "bob", Created: time.Now()})
+
+	if err := store.renameRoom("lobby", "hall"); err != nil {
+		t.Fatalf("renameRoom: %v", err)
+	}
+	if err := store.deleteRoom("games"); err != nil {
+		t.Fatalf("deleteRoom: %v", err)
+	}
+
+	reloaded, err := loadBans(path)
+	if err != nil {
+		t.Fatalf("loadBans: %v", err)
+	}
+	if _, banned := reloaded.find("hall", accountIdentity("bob"), ""); !banned {
+		t.Error("the ban did not move with the renamed room")
+	}
+	if _, banned := reloaded.find("lobby", accountIdentity("bob"), ""); banned {
+		t.Error("the ban stayed with the old room name")
+	}
+	if len(reloaded.list("games")) != 0 {
+		t.Error("the bans of the deleted room were kept")
+	}
+}
+
+func TestLoadBansRejectsBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	if err := os.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBans(path); err == nil {
+		t.Fatal("loadBans accepted a broken file")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	valid := map[string]time.Duration{
+		"7d":    7 * 24 * time.Hour,
+		"90m":   90 * time.Minute,
+		"2h30m": 2*time.Hour + 30*time.Minute,
+	}
+	for text, want := range valid {
+		if got, ok := parseDuration(text); !ok || got != want {
+			t.Errorf("parseDuration(%q) = %v, %v, want %v", text, got, ok, want)
+		}
+	}
+	for _, text := range []string{"", "0", "0d", "-1h", "-2d", "d", "soon", "7days"} {
+		if got, ok := parseDuration(text); ok {
+			t.Errorf("parseDuration(%q) = %v, want it refused", text, got)
+		}
+	}
+}
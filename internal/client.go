@@ -4,131 +4,621 @@ import (
 	"bufio"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"math/big"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var publicKey rsa.PublicKey
 var privateKey *rsa.PrivateKey
 var ServerPublicKey rsa.PublicKey
+var serverAddr string
+var knownHostsFile string
+
+// Settings for dialing the server, kept for reconnecting
+var clientTLS *tls.Config
+var skipKeyExchange bool
+
+// Largest encoded message the client sends or accepts, it has to be at most the limit of the server
+var maxMessageSize = defaultMaxMessageSize
+
+// Token the server handed out to resume the session with after the connection drops
+var resumeToken string
+
+// Delays between reconnect attempts, doubling from the first to the longest
+const (
+	reconnectDelay       = time.Second
+	maxReconnectDelay    = 30 * time.Second
+	maxReconnectAttempts = 10
+)
+
+// The client pings the server this often, and takes the connection for dead when nothing arrives for serverTimeout
+const (
+	pingInterval  = 30 * time.Second
+	serverTimeout = 90 * time.Second
+)
+
+// Returned when reconnecting needs the user to pick a name or enter a password again
+var errResumeRejected = errors.New("the server did not resume the session")
+
+// The connection to the server with its reader and session keys. It is replaced as a whole when the client reconnects
+type serverConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	session *sessionKeys
+}
+
+var current *serverConn
+var currentMu sync.Mutex
+
+// Returns the connection to the server
+func connection() *serverConn {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	return current
+}
+
+// Replaces the connection to the server
+func setConnection(sc *serverConn) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = sc
+}
+
+// The username of the client. The server confirms it on the reading goroutine, the others read it for the prompt and messages
 var usrname string
+var usrnameMu sync.Mutex
+
+// Returns the username of the client
+func username() string {
+	usrnameMu.Lock()
+	defer usrnameMu.Unlock()
+	return usrname
+}
+
+// Replaces the username of the client
+func setUsername(name string) {
+	usrnameMu.Lock()
+	defer usrnameMu.Unlock()
+	usrname = name
+}
+
+// Set once the server announced that it is shutting down
+var serverClosing int32
+
+// Set once the user typed /exit, the server then closes the connection
+var exiting int32
+var wg sync.WaitGroup
+
+// Direct messages waiting for the public key of their recipient, keyed by the nameKey of the recipient
+// Client keys change whenever a client starts, so the key is asked for again before each message
+var pendingDirect = make(map[string][]string)
+var pendingDirectMu sync.Mutex
+
+// Fingerprints of the keys direct messages were last encrypted to, so the user sees when a key changes
+var directKeys = make(map[string]string)
+
+// Input typed by the user. One scanner is kept for the whole session so lines buffered ahead of the current one are not lost
+var stdin = bufio.NewScanner(os.Stdin)
 
 // Monitors the socket continiosly for new messages
-func monitorSocket(conn net.Conn) {
+// A dropped connection is reconnected, the server gives the session back if it comes back in time
+func monitorSocket() {
 	defer wg.Done()
+	sc := connection()
 	for {
-		status, err := bufio.NewReader(conn).ReadString('\n')
-		checkError(err, "Unable to read input from the server ")
+		// Pongs to the pings of keepAlive arrive well within the timeout while the server is there
+		sc.conn.SetReadDeadline(time.Now().Add(serverTimeout))
+		frame, err := readFrame(sc.reader, maxMessageSize)
+		if err == errMessageTooLarge {
+			printAboveLine(red("A message from the server was larger than the limit of " + strconv.Itoa(maxMessageSize) + " bytes and was skipped"))
+			continue
+		}
+		if err != nil {
+			// The server said it is going down, so the closed connection is expected
+			if atomic.LoadInt32(&serverClosing) == 1 {
+				fmt.Println(yellow("\nDisconnected, the server shut down"))
+				os.Exit(0)
+			}
+			if atomic.LoadInt32(&exiting) == 1 {
+				fmt.Println(yellow("\nDisconnected"))
+				os.Exit(0)
+			}
+
+			sc.conn.Close()
+			sc = reconnect(err)
+			continue
+		}
 
-		status = decrypt(status, *privateKey)
-		status = strings.Trim(status, "\r\n")
-		status = strings.Trim(status, ">")
+		env, err := decodeEnvelope(frame, sc.session, maxMessageSize)
+		if err != nil {
+			printAboveLine(red("Unable to decode message from the server: " + err.Error()))
+			continue
+		}
 
-		printAboveLine(status)
+		// The server confirms every change of username, the prompt follows it
+		if env.Type == msgUsername {
+			setUsername(env.Sender)
+			if env.Payload == "" {
+				continue
+			}
+		}
+
+		switch env.Type {
+		case msgPublicKey:
+			sendDirect(env)
+			continue
+		case msgPing:
+			writeServer(envelope{Type: msgPong})
+			continue
+		case msgPong:
+			continue
+		case msgShutdown:
+			atomic.StoreInt32(&serverClosing, 1)
+		case msgRekey:
+			if err := sc.session.finishRekey(env.Payload); err != nil {
+				printAboveLine(red("Unable to rekey the session: " + err.Error()))
+				sc.conn.Close()
+			}
+			continue
+		case msgError:
+			// The session keeps its key, the next rekey is tried after the interval
+			if env.Code == errCodeRekeyFailed && sc.session != nil {
+				sc.session.cancelRekey()
+			}
+		case msgDirect:
+			msg, err := openDirect(env.Payload, privateKey)
+			if err != nil {
+				printAboveLine(red("Unable to decrypt a direct message from " + env.Sender + ": " + err.Error()))
+				continue
+			}
+			env.Payload = msg
+		}
+
+		printAboveLine(formatEnvelope(env))
 
 	}
 }
 
+// Connects again after the connection dropped, waiting longer after every failed attempt
+// The client exits if the server can not be reached or does not give the session back
+func reconnect(cause error) *serverConn {
+	printAboveLine(red("Connection to the server lost: " + cause.Error()))
+
+	delay := reconnectDelay
+	for attempt := 1; attempt <= maxReconnectAttempts; attempt++ {
+		printAboveLine(yellow("Reconnecting in " + delay.String() + " (attempt " + strconv.Itoa(attempt) + " of " + strconv.Itoa(maxReconnectAttempts) + ")"))
+		time.Sleep(delay)
+
+		sc, err := connect(true)
+		if err == nil {
+			setConnection(sc)
+			dropPendingDirect()
+			return sc
+		}
+		if errors.Is(err, errResumeRejected) || errors.Is(err, errHostKeyChanged) {
+			fmt.Println(red("\nUnable to reconnect: " + err.Error()))
+			os.Exit(1)
+		}
+		printAboveLine(red("Unable to reconnect: " + err.Error()))
+
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+
+	fmt.Println(red("\nGiving up, the server could not be reached"))
+	os.Exit(1)
+	return nil
+}
+
+// Turns an envelope received from the server into a line for the terminal
+func formatEnvelope(env envelope) string {
+	// A client can be in several rooms, so lines from a room say which one
+	if env.Room != "" && (env.Type == msgChat || env.Type == msgNotice) {
+		return cyan("#"+env.Room+" ") + formatEnvelope(envelope{Type: env.Type, Sender: env.Sender, Payload: env.Payload})
+	}
+
+	switch env.Type {
+	case msgError:
+		return red(env.Sender + ": " + env.Payload)
+	case msgUsername:
+		return blue("SERVER: ") + yellow(env.Payload)
+	case msgNotice:
+		return blue(env.Sender+": ") + yellow(env.Payload)
+	case msgShutdown:
+		return blue(env.Sender+": ") + red(env.Payload)
+	case msgDirect:
+		return purple(env.Sender+" (whisper, encrypted): ") + env.Payload
+	default:
+		return blue(env.Sender) + blue(": ") + env.Payload
+	}
+}
+
 // Gets input from the user and sends it to the server after encrypting
-func sendMessage(conn net.Conn) {
+func sendMessage() {
 	for {
-		fmt.Printf("\033[2K\r%s", purple(usrname+"> "))
-
-		scanner := bufio.NewScanner(os.Stdin)
-		scanner.Scan()
+		fmt.Printf("\033[2K\r%s", purple(username()+"> "))
 
-		err := scanner.Err()
-		checkError(err, "")
+		// Stops reading once the input is closed, messages from the server are still printed
+		if !stdin.Scan() {
+			checkError(stdin.Err(), "")
+			return
+		}
 
-		userInput := strings.Trim(scanner.Text(), "\r\n")
+		userInput := strings.Trim(stdin.Text(), "\r\n")
+		if userInput == "" {
+			continue
+		}
 		args := strings.Split(userInput, " ")
 
 		switch args[0] {
 
-		case "/help":
-			commandList := [13][3]string{USAGE, NAME, MSG, BROADCAST, SPAM, SHOUT, CREATE, JOIN, KICK, PROMOTE, QUIT, HELP, LIST}
-			for i := range commandList {
-				fmt.Printf("%5s%5s%5s\n", commandList[i][0], commandList[i][1], commandList[i][2])
+		case cmdHelp:
+			printHelp()
+
+		// The connection closing after /exit is not a drop, so it is not reconnected
+		case cmdExit:
+			atomic.StoreInt32(&exiting, 1)
+			writeServer(envelope{Type: msgCommand, Command: args[0], Args: args[1:]})
+
+		// Direct messages are encrypted for the recipient here, the server only passes them on
+		case cmdMsg:
+			rest := strings.TrimLeft(strings.TrimPrefix(userInput, args[0]), " ")
+			destination, msg, ok := strings.Cut(rest, " ")
+			msg = strings.TrimLeft(msg, " ")
+			if !ok || strings.TrimSpace(msg) == "" {
+				writeServer(envelope{Type: msgCommand, Command: args[0], Args: args[1:]})
+				continue
 			}
+			queueDirect(destination, msg)
 
-		case "/name":
-			usrname = args[1]
+		default:
+			writeServer(envelope{Type: msgCommand, Command: args[0], Args: args[1:]})
+		}
+	}
+}
 
-			msg := encrypt(scanner.Text(), ServerPublicKey)
+// Holds the direct message until the public key of the recipient arrives, and asks the server for the key
+func queueDirect(destination string, msg string) {
+	key := nameKey(destination)
 
-			_, err = conn.Write([]byte(msg + "\n"))
-			checkError(err, "")
+	pendingDirectMu.Lock()
+	pendingDirect[key] = append(pendingDirect[key], msg)
+	first := len(pendingDirect[key]) == 1
+	pendingDirectMu.Unlock()
 
-		default:
-			msg := encrypt(scanner.Text(), ServerPublicKey)
+	// One request is enough for every message queued while it is answered
+	if first {
+		writeServer(envelope{Type: msgKeyRequest, Payload: destination})
+	}
+}
+
+// Forgets the direct messages whose key requests were lost with the connection
+func dropPendingDirect() {
+	pendingDirectMu.Lock()
+	count := 0
+	for key, msgs := range pendingDirect {
+		count += len(msgs)
+		delete(pendingDirect, key)
+	}
+	pendingDirectMu.Unlock()
+
+	if count > 0 {
+		printAboveLine(red(strconv.Itoa(count) + " direct messages were not sent before the connection dropped"))
+	}
+}
+
+// Encrypts the messages waiting for the user whose public key arrived and sends them
+func sendDirect(env envelope) {
+	key := nameKey(env.Sender)
+
+	pendingDirectMu.Lock()
+	msgs := pendingDirect[key]
+	delete(pendingDirect, key)
+	pendingDirectMu.Unlock()
+
+	if env.Payload == "" {
+		printAboveLine(red("SERVER: No such user: " + env.Sender))
+		return
+	}
+
+	pub, err := decodePublicKey(env.Payload)
+	if err != nil {
+		printAboveLine(red("Unable to read the key of " + env.Sender + ": " + err.Error()))
+		return
+	}
+
+	// The key comes from the server, the fingerprint lets both users compare it out of band
+	fp := fingerprint(&pub)
+	if directKeys[key] != fp {
+		directKeys[key] = fp
+		printAboveLine(yellow("Encrypting messages to " + env.Sender + " with key " + fp))
+	}
 
-			_, err = conn.Write([]byte(msg + "\n"))
-			checkError(err, "")
+	for _, msg := range msgs {
+		sealed, err := sealDirect(msg, pub)
+		if err != nil {
+			printAboveLine(red("Unable to encrypt the message to " + env.Sender + ": " + err.Error()))
+			continue
 		}
+		writeServer(envelope{Type: msgDirect, To: env.Sender, Payload: sealed})
 	}
 }
 
+// Encrypts the envelope with the session key and sends it to the server
+// Messages over the size limit are reported to the user instead of being sent
+// While the connection is down the message is dropped, the reader notices the failure and reconnects
+func writeServer(env envelope) {
+	env.Sender = username()
+
+	sc := connection()
+	err := writeEnvelope(sc.conn, env, sc.session, maxMessageSize)
+	if err == errMessageTooLarge {
+		fmt.Println(red("Message is too long, the limit is " + strconv.Itoa(maxMessageSize) + " bytes"))
+		return
+	}
+	if err != nil {
+		printAboveLine(red("Not connected to the server, the message was not sent"))
+	}
+}
+
+// Dials the server over TLS if it is configured, plain TCP otherwise
+func dialServer() (net.Conn, error) {
+	if clientTLS != nil {
+		return tls.Dial(PROTOCOL, serverAddr, clientTLS)
+	}
+	return net.Dial(PROTOCOL, serverAddr)
+}
+
+// Connects to the server and runs the handshake
+// When resuming, the session of the dropped connection is asked for with its token and nothing is asked of the user
+func connect(resume bool) (*serverConn, error) {
+	conn, err := dialServer()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every read from the server goes through one reader that lives as long as the connection
+	sc := &serverConn{conn: conn, reader: bufio.NewReader(conn)}
+	if err := setusrname(sc, resume); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
 // Sets the username for the user for this session
-func setusrname(conn net.Conn) {
-	fmt.Print(blue("input username: "))
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Scan()
+func setusrname(sc *serverConn, resume bool) error {
+	// The hello message carries the username and the public key of the client
+	clientKey, err := encodePublicKey(&publicKey)
+	if err != nil {
+		return err
+	}
 
-	err := scanner.Err()
-	checkError(err, "")
+	err = writeEnvelope(sc.conn, envelope{Type: msgHello, Sender: username(), Payload: clientKey, Resume: resume}, nil, maxMessageSize)
+	if err != nil {
+		return err
+	}
 
-	pKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	checkError(err, "")
+	ServerPublicKey, err = setPublicKeyServer(sc.reader)
+	if err != nil {
+		return err
+	}
 
-	privateKey = pKey
-	publicKey = privateKey.PublicKey
+	// Over TLS the certificate already proves who the server is and the key exchange can be left out
+	if skipKeyExchange {
+		err = writeEnvelope(sc.conn, envelope{Type: msgSession, Sender: username()}, nil, maxMessageSize)
+		if err != nil {
+			return err
+		}
 
-	usrname = strings.Trim(scanner.Text(), "\r\n")
-	_, err = conn.Write([]byte(scanner.Text() + "\n"))
+		env, err := readEnvelope(sc.reader, nil, maxMessageSize)
+		if err != nil {
+			return err
+		}
+		if env.Type != msgSession || env.Payload != "" {
+			return fmt.Errorf("expected an empty %s, got %s", msgSession, env.Type)
+		}
+	} else {
+		if err := verifyServerKey(serverAddr, &ServerPublicKey); err != nil {
+			return err
+		}
+		if sc.session, err = agreeSessionKeys(sc.conn, sc.reader); err != nil {
+			return err
+		}
+	}
 
-	checkError(err, "")
-	time.Sleep(100 * time.Millisecond)
+	if resume {
+		err = writeEnvelope(sc.conn, envelope{Type: msgResume, Sender: username(), Token: resumeToken}, sc.session, maxMessageSize)
+		if err != nil {
+			return err
+		}
+	}
 
-	_, err = conn.Write([]byte(publicKey.N.String() + " " + strconv.Itoa(publicKey.E) + "\n"))
-	checkError(err, "")
+	// The server either accepts the username or says why not, in which case another one is asked for
+	for {
+		env, err := readEnvelope(sc.reader, sc.session, maxMessageSize)
+		if err != nil {
+			return err
+		}
+
+		if env.Type == msgUsername {
+			setUsername(env.Sender)
+			resumeToken = env.Token
+			if env.Payload != "" {
+				fmt.Println(formatEnvelope(env))
+			}
+			return nil
+		}
+		if env.Type != msgError || (env.Code != errCodeNameRejected && env.Code != errCodeAuthRequired) {
+			return fmt.Errorf("expected %s, got %s", msgUsername, env.Type)
+		}
+
+		// Another name or a password can not be asked for while reconnecting, the input belongs to the chat then
+		if resume {
+			return fmt.Errorf("%w: %s", errResumeRejected, env.Payload)
+		}
+
+		fmt.Println(red(env.Payload))
+
+		// Registered names need the password of the account, an empty password picks another name instead
+		password := ""
+		if env.Code == errCodeAuthRequired {
+			password = readLine(blue("password for " + username() + " (empty to pick another name): "))
+		}
+		if password == "" {
+			setUsername(readUsername())
+		}
 
-	ServerPublicKey = setPublicKeyServer(conn)
+		err = writeEnvelope(sc.conn, envelope{Type: msgHello, Sender: username(), Payload: password}, sc.session, maxMessageSize)
+		if err != nil {
+			return err
+		}
+	}
 }
 
-// The first message received from the server is the public key of the server for encrypting the messages
-// So only server can decrypt it by using the server private key
-func setPublicKeyServer(conn net.Conn) rsa.PublicKey {
-	for {
-		userInput, err := bufio.NewReader(conn).ReadString('\n')
+// Agrees on the session keys with an ephemeral key, so recorded traffic stays safe even if the long-term keys leak later
+// Every message after this point is encrypted with the session keys
+func agreeSessionKeys(conn net.Conn, reader *bufio.Reader) (*sessionKeys, error) {
+	priv, pub, err := newEphemeralKey()
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeEnvelope(conn, envelope{Type: msgSession, Sender: username(), Payload: base64.StdEncoding.EncodeToString(pub)}, nil, maxMessageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ephemeral key of the server has to be signed by the pinned server key
+	env, err := readEnvelope(reader, nil, maxMessageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.Type != msgSession {
+		return nil, fmt.Errorf("expected %s, got %s", msgSession, env.Type)
+	}
+
+	key, serverPub, err := agreeKey(priv, env.Payload, true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to agree on a session key: %w", err)
+	}
 
-		checkError(err, "")
+	if err := verifyHandshake(&ServerPublicKey, pub, serverPub, env.Signature); err != nil {
+		return nil, fmt.Errorf("the server key did not sign the key exchange: %w", err)
+	}
+
+	return newSessionKeys(key)
+}
+
+// Starts a rekey with the server every rekeyInterval, the old key is forgotten after the next one
+func rekeySession() {
+	ticker := time.NewTicker(rekeyInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sc := connection()
+		if sc.session == nil {
+			continue
+		}
 
-		if userInput != "" {
-			userInput = strings.Trim(userInput, "\r\n")
-			args := strings.Split(userInput, " ")
-			N := strings.TrimSpace(args[0])
-			E := strings.TrimSpace(args[1])
+		pub, err := sc.session.startRekey()
+		if err != nil {
+			printAboveLine(red("Unable to rekey the session: " + err.Error()))
+			continue
+		}
+		if pub != "" {
+			writeServer(envelope{Type: msgRekey, Payload: pub})
+		}
+	}
+}
 
-			var pKey rsa.PublicKey
-			i := new(big.Int)
-			_, err := fmt.Sscan(N, i)
+// Pings the server every pingInterval so a dead connection is noticed even when nobody is talking
+func keepAlive() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
 
-			checkError(err, "error scanning value: ")
+	for range ticker.C {
+		writeServer(envelope{Type: msgPing})
+	}
+}
+
+// Asks the user for a username
+func readUsername() string {
+	return readLine(blue("input username: "))
+}
+
+// Prints the prompt and reads one line typed by the user
+func readLine(prompt string) string {
+	fmt.Print(prompt)
+	if !stdin.Scan() {
+		checkError(stdin.Err(), "")
+		os.Exit(0)
+	}
+	return strings.Trim(stdin.Text(), "\r\n")
+}
+
+// The first message received from the server is the public key of the server for encrypting the messages
+// So only server can decrypt it by using the server private key
+func setPublicKeyServer(reader *bufio.Reader) (rsa.PublicKey, error) {
+	env, err := readEnvelope(reader, nil, maxMessageSize)
+	if err != nil {
+		return rsa.PublicKey{}, err
+	}
 
-			pKey.N = i
-			pKey.E, err = strconv.Atoi(E)
+	if env.Type != msgKey {
+		return rsa.PublicKey{}, fmt.Errorf("expected %s, got %s", msgKey, env.Type)
+	}
 
-			checkError(err, "error scanning value: ")
+	pKey, err := decodePublicKey(env.Payload)
+	if err != nil {
+		return rsa.PublicKey{}, fmt.Errorf("error decoding server key: %w", err)
+	}
+	return pKey, nil
+}
 
-			return pKey
+// Checks the server key against the fingerprint recorded for the address the first time the client connected to it
+// A changed key could mean someone is intercepting the connection, so the client refuses to continue
+func verifyServerKey(addr string, key *rsa.PublicKey) error {
+	fp := fingerprint(key)
+
+	path := knownHostsFile
+	if path == "" {
+		var err error
+		path, err = knownHostsPath()
+		if err != nil {
+			return fmt.Errorf("unable to find the known hosts file: %w", err)
 		}
 	}
+
+	known, err := checkKnownHost(path, addr, fp)
+	if err == errHostKeyChanged {
+		fmt.Println(red("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@"))
+		fmt.Println(red("@    WARNING: THE SERVER KEY HAS CHANGED                 @"))
+		fmt.Println(red("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@"))
+		fmt.Println(red("Someone could be intercepting this connection, or the server key was replaced."))
+		fmt.Println(red("The server at " + addr + " presented the key " + fp + "."))
+		fmt.Println(red("If the change is expected, remove the line for " + addr + " from " + path + "."))
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("unable to check the known hosts file: %w", err)
+	}
+
+	if !known {
+		fmt.Println(yellow("First connection to " + addr + ", trusting the server key " + fp))
+	}
+	return nil
 }
 
 // Prints the received message 1 line above the current line
@@ -140,7 +630,7 @@ func printAboveLine(s string) {
 	fmt.Print("\033[L")
 	fmt.Println(s)
 	fmt.Print("\0338")
-	fmt.Printf("\033[2K\r%s", purple(usrname+"> "))
+	fmt.Printf("\033[2K\r%s", purple(username()+"> "))
 }
 
 // Checks and prints the errors
@@ -152,24 +642,49 @@ func checkError(err error, errMsg string) {
 }
 
 // Main function that starts the goroutines and connects to the port by dialing in
-func RunClient() {
-	wg := sync.WaitGroup{}
-
+func RunClient(settings ClientSettings) {
 	fmt.Println("Client Starting...")
 
-	// Dial in using a protocol and a port
-	conn, err := net.Dial(PROTOCOL, PORT)
+	serverAddr = settings.Addr()
+	knownHostsFile = settings.KnownHostsFile
 
+	var err error
+	clientTLS, err = ClientTLSConfig(settings.TLS, serverAddr)
+	checkError(err, "Unable to set up TLS: ")
+	skipKeyExchange = clientTLS != nil && settings.TLS.SkipKeyExchange
+	if settings.MaxMessageSize > 0 {
+		maxMessageSize = settings.MaxMessageSize
+	}
+	if maxMessageSize < minMaxMessageSize {
+		checkError(fmt.Errorf("the maximum message size has to be at least %d bytes", minMaxMessageSize), "")
+	}
+
+	stdin.Buffer(make([]byte, 4096), maxMessageSize)
+
+	// A username from the settings is tried first, another one is asked for if the server turns it down
+	setUsername(settings.Username)
+	if username() == "" {
+		setUsername(readUsername())
+	}
+
+	// The key direct messages are encrypted to. It stays the same across reconnects
+	privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	checkError(err, "")
+	publicKey = privateKey.PublicKey
+
+	// Dial in using a protocol and a port
+	sc, err := connect(false)
 	if err != nil {
 		fmt.Println("Unable to connect to server: ", err.Error())
 		os.Exit(0)
 	}
-
-	setusrname(conn)
+	setConnection(sc)
 
 	wg.Add(1)
-	go monitorSocket(conn)
-	go sendMessage(conn)
+	go monitorSocket()
+	go sendMessage()
+	go rekeySession()
+	go keepAlive()
 
 	wg.Wait()
 }
@@ -1,5 +1,11 @@
 package internal
 
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
 // Command names
 const (
 	cmdName       string = "/name"    //Done
@@ -16,4 +22,230 @@ const (
 	cmdHelp       string = "/help"    //Done
 	cmdList       string = "/list"    //Done
 	cmdListRooms  string = "/rooms"   //Done
+	cmdSwitchRoom string = "/switch"
+	cmdDeleteRoom string = "/deleteroom"
+	cmdRenameRoom string = "/renameroom"
+	cmdTransfer   string = "/transfer"
+	cmdDemote     string = "/demote"
+	cmdMods       string = "/mods"
+	cmdBan        string = "/ban"
+	cmdUnban      string = "/unban"
+	cmdBans       string = "/bans"
+	cmdMute       string = "/mute"
+	cmdUnmute     string = "/unmute"
+	cmdModerated  string = "/moderated"
+	cmdVoice      string = "/voice"
+	cmdDevoice    string = "/devoice"
+	cmdInvite     string = "/invite"
+	cmdInviteOnly string = "/inviteonly"
+	cmdRegister   string = "/register"
+	cmdLogin      string = "/login"
+)
+
+// Error codes sent in error envelopes, so clients can react to a failure without parsing the text
+const (
+	errCodeUnknownCommand string = "unknown_command"
+	errCodeUsage          string = "usage"
+	errCodeDenied         string = "permission_denied"
+	errCodeNotFound       string = "not_found"
+	errCodeFailed         string = "failed"
+	errCodeTooLarge       string = "too_large"
+	errCodeNameRejected   string = "name_rejected"
+	errCodeAuthRequired   string = "auth_required"
+	errCodeRekeyFailed    string = "rekey_failed"
+)
+
+// Kinds of command arguments, checked before the handler runs
+type argKind int
+
+const (
+	argWord  argKind = iota // a single word such as a username or a room name
+	argCount                // a whole number between 1 and the max of the argument
+	argText                 // the rest of the line, spaces included
 )
+
+// One argument of a command
+type commandArg struct {
+	name     string
+	kind     argKind
+	optional bool
+	max      int // upper bound for argCount
+}
+
+// Each command is a struct that describes its arguments and the function that runs it
+// The handler receives one value per declared argument, optional arguments that were left out are empty
+type command struct {
+	name        string
+	args        []commandArg
+	description string
+	handler     func(s *Server, cli *client, args []string) error
+}
+
+// Every command the server understands, in the order /help lists them
+// Filled in by init because the help handler reads the table itself
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{cmdName, []commandArg{{name: "new_name"}}, "Sets new username", (*Server).handleName},
+		{cmdMsg, []commandArg{{name: "receiver_username"}, {name: "message", kind: argText}}, "Sends a DM, encrypted by your client so only the receiver can read it", (*Server).handleMsg},
+		{cmdBroadcast, []commandArg{{name: "message", kind: argText}}, "Sends a message to all users in the current room, or in #room_name if the message starts with it", (*Server).handleBroadcast},
+		{cmdSpam, []commandArg{{name: "spam_n_times", kind: argCount, max: 20}, {name: "message", kind: argText}}, "Spams the room 'N' times, #room_name works like for /all", (*Server).handleSpam},
+		{cmdShout, []commandArg{{name: "message", kind: argText}}, "Sends a message to room in capitals, #room_name works like for /all", (*Server).handleShout},
+		{cmdCreateRoom, []commandArg{{name: "room_name"}, {name: "--key secret", kind: argText, optional: true}}, "Creates a new room with the specified name, users have to give the secret to join it if a key is set", (*Server).handleCreateRoom},
+		{cmdJoinRoom, []commandArg{{name: "room_name"}, {name: "key", kind: argText, optional: true}}, "Joins a room and makes it the current room, the rooms you are in are kept. Rooms with a key need the key", (*Server).handleJoinRoom},
+		{cmdSwitchRoom, []commandArg{{name: "room_name", optional: true}}, "Makes one of your rooms the current room, lists your rooms without a name", (*Server).handleSwitchRoom},
+		{cmdDeleteRoom, nil, "Deletes the current room, you have to be its admin", (*Server).handleDeleteRoom},
+		{cmdRenameRoom, []commandArg{{name: "new_name"}}, "Renames the current room, you have to be its admin", (*Server).handleRenameRoom},
+		{cmdTransfer, []commandArg{{name: "username"}}, "Makes a user in the current room its admin, you have to be the admin", (*Server).handleTransfer},
+		{cmdKick, []commandArg{{name: "username"}, {name: "reason", kind: argText, optional: true}}, "Kicks the user out of the room for a while, you have to rank above them", (*Server).handleKick},
+		{cmdBan, []commandArg{{name: "username"}, {name: "duration", optional: true}, {name: "reason", kind: argText, optional: true}}, "Bans the user from the room, for a duration such as 30m or 7d if one is given", (*Server).handleBan},
+		{cmdUnban, []commandArg{{name: "username"}}, "Lifts the ban of the user from the room", (*Server).handleUnban},
+		{cmdBans, nil, "Lists the bans of the room, you have to be a mod", (*Server).handleBans},
+		{cmdMute, []commandArg{{name: "username"}, {name: "duration", optional: true}}, "Keeps the user from talking in the room, for a duration such as 10m if one is given", (*Server).handleMute},
+		{cmdUnmute, []commandArg{{name: "username"}}, "Lets a muted user talk in the room again", (*Server).handleUnmute},
+		{cmdModerated, []commandArg{{name: "on|off", optional: true}}, "Lets only mods and voiced users talk in the room, shows the mode without an argument", (*Server).handleModerated},
+		{cmdVoice, []commandArg{{name: "username"}}, "Lets the user talk while the room is moderated", (*Server).handleVoice},
+		{cmdDevoice, []commandArg{{name: "username"}}, "Takes the voice of the user away", (*Server).handleDevoice},
+		{cmdInvite, []commandArg{{name: "username"}}, "Invites the user to the room, they can join without the key or while it is invite only", (*Server).handleInvite},
+		{cmdInviteOnly, []commandArg{{name: "on|off", optional: true}}, "Lets only invited users join the room, shows the mode without an argument", (*Server).handleInviteOnly},
+		{cmdPromote, []commandArg{{name: "username"}}, "Promotes a user to a mod in the room", (*Server).handlePromote},
+		{cmdDemote, []commandArg{{name: "username"}}, "Demotes a mod of the room to a member, you have to be the admin", (*Server).handleDemote},
+		{cmdMods, []commandArg{{name: "room_name", optional: true}}, "Lists the admin and the mods of the room, the current room without a name", (*Server).handleMods},
+		{cmdListRooms, nil, "Shows the available rooms", (*Server).handleListRooms},
+		{cmdQuitRoom, []commandArg{{name: "room_name", optional: true}}, "Quits the room, the current room without a name", (*Server).handleQuitRoom},
+		{cmdList, []commandArg{{name: "room_name", optional: true}}, "Lists active users", (*Server).handleList},
+		{cmdRegister, []commandArg{{name: "password", kind: argText}}, "Registers an account for your username", (*Server).handleRegister},
+		{cmdLogin, []commandArg{{name: "username"}, {name: "password", kind: argText}}, "Logs in to an account", (*Server).handleLogin},
+		{cmdHelp, nil, "Lists all commands", (*Server).handleHelp},
+		{cmdExit, nil, "Closes the client connection", (*Server).handleExit},
+	}
+}
+
+// Returned by the /exit handler to end the connection
+var errClientExit = errors.New("client left")
+
+// An error that is sent back to the client that ran the command
+type commandError struct {
+	code string
+	msg  string
+}
+
+func (e *commandError) Error() string {
+	return e.msg
+}
+
+// Creates an error telling the client they are not allowed to run the command
+func errDenied(msg string) error {
+	return &commandError{errCodeDenied, msg}
+}
+
+// Creates an error telling the client the user or room they named does not exist
+func errNotFound(msg string) error {
+	return &commandError{errCodeNotFound, msg}
+}
+
+// Returns the command with the given name, or nil
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Returns the usage line of the command, for example "/join <room_name>"
+func (c *command) usage() string {
+	return c.name + c.argUsage()
+}
+
+// Returns the arguments part of the usage line, optional arguments are in square brackets
+func (c *command) argUsage() string {
+	var b strings.Builder
+	for _, a := range c.args {
+		if a.optional {
+			b.WriteString(" [" + a.name + "]")
+		} else {
+			b.WriteString(" <" + a.name + ">")
+		}
+	}
+	return b.String()
+}
+
+// Checks the raw words sent by the client against the declared arguments and returns one value per argument
+// Words are split on single spaces by the terminal client, so empty words between double spaces are skipped
+func (c *command) parseArgs(words []string) ([]string, error) {
+	values := make([]string, len(c.args))
+
+	i := 0
+	for n, a := range c.args {
+		for i < len(words) && strings.TrimSpace(words[i]) == "" {
+			i++
+		}
+
+		if i == len(words) {
+			if !a.optional {
+				return nil, c.usageError("missing " + a.name)
+			}
+			continue
+		}
+
+		switch a.kind {
+		case argText:
+			values[n] = strings.Join(words[i:], " ")
+			i = len(words)
+
+		case argCount:
+			count, err := strconv.Atoi(strings.TrimSpace(words[i]))
+			if err != nil || count < 1 || count > a.max {
+				return nil, c.usageError(a.name + " must be a number from 1 to " + strconv.Itoa(a.max))
+			}
+			values[n] = strconv.Itoa(count)
+			i++
+
+		default:
+			values[n] = strings.TrimSpace(words[i])
+			i++
+		}
+	}
+
+	for ; i < len(words); i++ {
+		if strings.TrimSpace(words[i]) != "" {
+			return nil, c.usageError("too many arguments")
+		}
+	}
+	return values, nil
+}
+
+// Creates a usage error with the reason and the usage line of the command
+func (c *command) usageError(reason string) error {
+	return &commandError{errCodeUsage, reason + ", usage: " + c.usage()}
+}
+
+// Looks up the command in the envelope, checks its arguments and runs it
+// Problems are reported to the client with an error envelope. errClientExit is returned when the client leaves
+func (s *Server) runCommand(cli *client, env envelope) error {
+	cmd := findCommand(strings.TrimSpace(env.Command))
+	if cmd == nil {
+		s.sendError(errCodeUnknownCommand, "No such command: "+env.Command+", type /help for the list of commands", cli)
+		return nil
+	}
+
+	args, err := cmd.parseArgs(env.Args)
+	if err == nil {
+		err = cmd.handler(s, cli, args)
+	}
+
+	var cmdErr *commandError
+	switch {
+	case err == nil:
+	case err == errClientExit:
+		return err
+	case errors.As(err, &cmdErr):
+		s.sendError(cmdErr.code, cmdErr.msg, cli)
+	default:
+		s.sendError(errCodeFailed, err.Error(), cli)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	spam := &command{name: "/spam", args: []commandArg{{name: "n", kind: argCount, max: 20}, {name: "message", kind: argText}}}
+	kick := &command{name: "/kick", args: []commandArg{{name: "username"}, {name: "reason", kind: argText, optional: true}}}
+	ban := &command{name: "/ban", args: []commandArg{{name: "username"}, {name: "duration", optional: true}, {name: "reason", kind: argText, optional: true}}}
+	quit := &command{name: "/quit", args: []commandArg{{name: "room_name", optional: true}}}
+	rooms := &command{name: "/rooms"}
+
+	tests := []struct {
+		name    string
+		cmd     *command
+		words   []string
+		want    []string
+		wantErr string
+	}{
+		{"count and text", spam, []string{"3", "hello", "there"}, []string{"3", "hello there"}, ""},
+		{"count at the upper bound", spam, []string{"20", "x"}, []string{"20", "x"}, ""},
+		{"count of zero", spam, []string{"0", "x"}, nil, "n must be a number from 1 to 20"},
+		{"count over the bound", spam, []string{"21", "x"}, nil, "n must be a number from 1 to 20"},
+		{"count that is not a number", spam, []string{"three", "x"}, nil, "n must be a number from 1 to 20"},
+		{"missing text", spam, []string{"3"}, nil, "missing message"},
+		{"missing every argument", spam, nil, nil, "missing n"},
+		{"text keeps double spaces", kick, []string{"bob", "too", "", "loud"}, []string{"bob", "too  loud"}, ""},
+		{"empty words before an argument are skipped", kick, []string{"", "bob"}, []string{"bob", ""}, ""},
+		{"optional text left out", kick, []string{"bob"}, []string{"bob", ""}, ""},
+		{"every optional argument left out", ban, []string{"bob"}, []string{"bob", "", ""}, ""},
+		{"optional word given", ban, []string{"bob", "7d", "spam"}, []string{"bob", "7d", "spam"}, ""},
+		{"optional argument alone", quit, nil, []string{""}, ""},
+		{"too many arguments", quit, []string{"lobby", "games"}, nil, "too many arguments"},
+		{"trailing empty words", quit, []string{"lobby", "", ""}, []string{"lobby"}, ""},
+		{"arguments to a command without any", rooms, []string{"lobby"}, nil, "too many arguments"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cmd.parseArgs(tt.words)
+			if tt.wantErr != "" {
+				cmdErr, ok := err.(*commandError)
+				if !ok || cmdErr.code != errCodeUsage || !strings.Contains(cmdErr.msg, tt.wantErr) {
+					t.Fatalf("parseArgs(%q) error = %v, want a usage error with %q", tt.words, err, tt.wantErr)
+				}
+				if !strings.Contains(cmdErr.msg, tt.cmd.usage()) {
+					t.Errorf("usage error %q does not show the usage %q", cmdErr.msg, tt.cmd.usage())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseArgs(%q): %v", tt.words, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseArgs(%q) = %q, want %q", tt.words, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArgUsage(t *testing.T) {
+	ban := &command{name: "/ban", args: []commandArg{{name: "username"}, {name: "duration", optional: true}}}
+	if got, want := ban.usage(), "/ban <username> [duration]"; got != want {
+		t.Fatalf("usage() = %q, want %q", got, want)
+	}
+}
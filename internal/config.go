@@ -0,0 +1,375 @@
+package internal
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Port the server listens on and the client connects to unless configured otherwise
+const defaultPort = 8080
+
+// Prefix of the environment variables, the rest is the option name in capitals with '_' for '-'
+const envPrefix = "CHAT_"
+
+// Explains where settings come from, printed at the top of -h
+const settingsPrecedence = `Every option can be set, from highest to lowest precedence, by:
+  1. the command line flag, e.g. -port 9000
+  2. the environment variable, e.g. CHAT_PORT=9000
+  3. the TOML config file given by -config or CHAT_CONFIG, e.g. port = 9000
+  4. the built in default
+One config file can hold the settings of both the server and the client. Keys at the top
+apply to whichever side has the option, keys under [server] or [client] only to that side.
+`
+
+// Settings of the server binary
+type ServerSettings struct {
+	Address      string // host to listen on, all interfaces when empty
+	Port         int
+	LogFile      string
+	KeyFile      string
+	AccountsFile string
+	BansFile     string
+	TLS          TLSOptions
+
+	MaxMessageSize int    // bytes of the largest encoded message
+	ReservedNames  string // comma separated usernames nobody can take
+
+	ShutdownNotice int // seconds clients are warned before the server stops
+	ResumeGrace    int // seconds a dropped connection can be resumed
+	IdleTimeout    int // seconds a client can send nothing before it is evicted
+	PingInterval   int // seconds between the pings the server sends every client
+
+	AutoCreateRooms bool // /join creates rooms that do not exist
+	EmptyRoomTTL    int  // seconds a room nobody is in is kept
+	KickCooldown    int  // seconds a kicked user has to wait before joining the room again
+	BanByIP         bool // bans of accounts keep out the IP address of the banned user too, guest bans always do
+	InviteTTL       int  // seconds an invitation to a room holds
+}
+
+// Settings of the client binary
+type ClientSettings struct {
+	Address        string // host of the server
+	Port           int
+	Username       string // asked for when empty
+	KnownHostsFile string // ~/.chat_server/known_hosts when empty
+	MaxMessageSize int    // bytes of the largest encoded message, at most the limit of the server
+	TLS            TLSOptions
+}
+
+// Returns the address to listen on
+func (s ServerSettings) Addr() string {
+	return net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+}
+
+// Returns the reserved usernames, an empty setting reserves none
+func (s ServerSettings) reservedNames() []string {
+	names := []string{}
+	for _, name := range strings.Split(s.ReservedNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Returns the address of the server
+func (s ClientSettings) Addr() string {
+	return net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+}
+
+// One setting. The name is used for the flag, the key in the config file and the environment variable
+// The value points to a string, int or bool field of the settings
+type option struct {
+	name  string
+	usage string
+	value interface{}
+}
+
+// The options of the server, pointing into the settings
+func serverOptions(s *ServerSettings) []option {
+	return []option{
+		{"address", "`host` to listen on, all interfaces when empty", &s.Address},
+		{"port", "`port` to listen on", &s.Port},
+		{"log-file", "`file` the session log is written to", &s.LogFile},
+		{"key-file", "PEM `file` of the server identity key, created if missing", &s.KeyFile},
+		{"accounts-file", "JSON `file` registered accounts are kept in", &s.AccountsFile},
+		{"bans-file", "JSON `file` room bans are kept in", &s.BansFile},
+		{"max-message-size", "`bytes` of the largest encoded message the server sends or accepts", &s.MaxMessageSize},
+		{"reserved-names", "comma separated `names` nobody can take as a username, compared without case, empty to reserve none", &s.ReservedNames},
+		{"shutdown-notice", "`seconds` clients are warned before the server stops on SIGINT or SIGTERM", &s.ShutdownNotice},
+		{"resume-grace", "`seconds` the name, room and rights of a dropped connection are kept for the client to reconnect, 0 to drop at once", &s.ResumeGrace},
+		{"idle-timeout", "`seconds` a client can send nothing, not even a pong, before it is evicted, 0 to never evict", &s.IdleTimeout},
+		{"ping-interval", "`seconds` between the pings the server sends every client, 0 to not ping", &s.PingInterval},
+		{"auto-create-rooms", "create the room on /join when it does not exist, with the joiner as its admin", &s.AutoCreateRooms},
+		{"empty-room-ttl", "`seconds` a room nobody is in is kept before it is removed, 0 to keep rooms until they are deleted", &s.EmptyRoomTTL},
+		{"kick-cooldown", "`seconds` a kicked user has to wait before joining the room again, 0 to let them join at once", &s.KickCooldown},
+		{"invite-ttl", "`seconds` an invitation to a room holds", &s.InviteTTL},
+		{"ban-ip", "bans of accounts keep out everyone connecting from the IP address of the banned user, guest bans always do", &s.BanByIP},
+		{"tls-cert", "certificate `file` to serve TLS with, PEM", &s.TLS.CertFile},
+		{"tls-key", "private key `file` of the TLS certificate, PEM", &s.TLS.KeyFile},
+		{"tls-client-ca", "CA bundle `file` to require and verify client certificates with, PEM", &s.TLS.CAFile},
+	}
+}
+
+// The options of the client, pointing into the settings
+func clientOptions(s *ClientSettings) []option {
+	return []option{
+		{"address", "`host` of the server", &s.Address},
+		{"port", "`port` of the server", &s.Port},
+		{"username", "`name` to connect with, asked for when empty", &s.Username},
+		{"known-hosts", "`file` the pinned server keys are kept in, ~/.chat_server/known_hosts when empty", &s.KnownHostsFile},
+		{"max-message-size", "`bytes` of the largest encoded message the client sends or accepts, at most the limit of the server", &s.MaxMessageSize},
+		{"tls", "connect to the server over TLS", &s.TLS.Enabled},
+		{"tls-ca", "CA bundle `file` to verify the server certificate with instead of the system roots, PEM", &s.TLS.CAFile},
+		{"tls-cert", "client certificate `file` for servers that require one, PEM", &s.TLS.CertFile},
+		{"tls-key", "private key `file` of the client certificate, PEM", &s.TLS.KeyFile},
+		{"tls-insecure-skip-verify", "accept any server certificate, only for local testing", &s.TLS.InsecureSkipVerify},
+		{"tls-skip-key-exchange", "rely on TLS alone and skip the in-band key exchange", &s.TLS.SkipKeyExchange},
+	}
+}
+
+// Reads the server settings from the command line arguments, the environment and the config file
+func LoadServerSettings(program string, args []string) (ServerSettings, error) {
+	settings := ServerSettings{
+		Port:         defaultPort,
+		LogFile:      logFileName,
+		KeyFile:      keyFileName,
+		AccountsFile: accountsFileName,
+		BansFile:     bansFileName,
+
+		MaxMessageSize: defaultMaxMessageSize,
+		ReservedNames:  strings.Join(defaultReservedNames, ","),
+
+		ShutdownNotice: 5,
+		ResumeGrace:    30,
+		IdleTimeout:    90,
+		PingInterval:   30,
+		EmptyRoomTTL:   600,
+		KickCooldown:   60,
+		InviteTTL:      600,
+	}
+	err := loadSettings(program, args, "server", serverOptions(&settings))
+	return settings, err
+}
+
+// Reads the client settings from the command line arguments, the environment and the config file
+func LoadClientSettings(program string, args []string) (ClientSettings, error) {
+	settings := ClientSettings{
+		Address:        "localhost",
+		Port:           defaultPort,
+		MaxMessageSize: defaultMaxMessageSize,
+	}
+	err := loadSettings(program, args, "client", clientOptions(&settings))
+	return settings, err
+}
+
+// Applies the config file, the environment and the flags to the options in increasing order of precedence
+// Returns flag.ErrHelp when -h was given, the usage has been printed then
+func loadSettings(program string, args []string, side string, options []option) error {
+	flags := flag.NewFlagSet(program, flag.ContinueOnError)
+	configFile := flags.String("config", "", "TOML config `file`, also read from "+envPrefix+"CONFIG")
+
+	// Flags are only recorded while parsing, they are applied last so they win over the other sources
+	given := make(map[string]string)
+	for _, opt := range options {
+		_, isBool := opt.value.(*bool)
+		flags.Var(&recordedFlag{name: opt.name, given: given, isBool: isBool, def: optionDefault(opt.value)}, opt.name, opt.usage)
+	}
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage of %s:\n%s\nOptions:\n", program, settingsPrecedence)
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+	if path != "" {
+		if err := applyConfigFile(path, side, options); err != nil {
+			return err
+		}
+	}
+
+	for _, opt := range options {
+		if value, ok := os.LookupEnv(envName(opt.name)); ok {
+			if err := setOption(opt, value); err != nil {
+				return fmt.Errorf("%s: %w", envName(opt.name), err)
+			}
+		}
+	}
+
+	for _, opt := range options {
+		if value, ok := given[opt.name]; ok {
+			if err := setOption(opt, value); err != nil {
+				return fmt.Errorf("-%s: %w", opt.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Sets the options found in the TOML file, first the keys at the top and then the ones in the table of the side
+// Keys that are not an option of either side are refused so typos do not go unnoticed
+func applyConfigFile(path string, side string, options []option) error {
+	values := make(map[string]interface{})
+	if _, err := toml.DecodeFile(path, &values); err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	byName := make(map[string]option)
+	for _, opt := range options {
+		byName[opt.name] = opt
+	}
+
+	// Options of the other side are skipped at the top of the file
+	known := make(map[string]bool)
+	for _, opt := range serverOptions(&ServerSettings{}) {
+		known[opt.name] = true
+	}
+	for _, opt := range clientOptions(&ClientSettings{}) {
+		known[opt.name] = true
+	}
+
+	for _, key := range sortedKeys(values) {
+		if key == "server" || key == "client" {
+			if _, ok := values[key].(map[string]interface{}); !ok {
+				return fmt.Errorf("%s: %s has to be a table", path, key)
+			}
+			continue
+		}
+
+		opt, ok := byName[key]
+		if !ok {
+			if known[key] {
+				continue
+			}
+			return fmt.Errorf("%s: unknown option %q", path, key)
+		}
+		if err := setOption(opt, configValue(values[key])); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+
+	table, _ := values[side].(map[string]interface{})
+	for _, key := range sortedKeys(table) {
+		opt, ok := byName[key]
+		if !ok {
+			return fmt.Errorf("%s: unknown %s option %q", path, side, key)
+		}
+		if err := setOption(opt, configValue(table[key])); err != nil {
+			return fmt.Errorf("%s: %s.%s: %w", path, side, key, err)
+		}
+	}
+	return nil
+}
+
+// Returns the text of a value of the config file. Arrays are joined with commas, as list options are given elsewhere
+func configValue(value interface{}) string {
+	list, ok := value.([]interface{})
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	items := make([]string, len(list))
+	for i, item := range list {
+		items[i] = fmt.Sprint(item)
+	}
+	return strings.Join(items, ",")
+}
+
+// Returns the keys of the map in order, so errors in a config file are always reported for the same key
+func sortedKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Parses the text for the type of the option and stores it
+func setOption(opt option, value string) error {
+	switch v := opt.value.(type) {
+	case *string:
+		*v = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("not a number: " + value)
+		}
+		*v = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("not true or false: " + value)
+		}
+		*v = b
+	default:
+		return fmt.Errorf("option %s has an unsupported type %T", opt.name, opt.value)
+	}
+	return nil
+}
+
+// Returns the environment variable of an option, CHAT_LOG_FILE for log-file
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Returns the value an option points to for showing it as the default, empty for zero values
+func optionDefault(value interface{}) string {
+	switch v := value.(type) {
+	case *string:
+		return *v
+	case *int:
+		if *v != 0 {
+			return strconv.Itoa(*v)
+		}
+	case *bool:
+		if *v {
+			return "true"
+		}
+	}
+	return ""
+}
+
+// A flag that only records the text it was given, see loadSettings
+type recordedFlag struct {
+	name   string
+	given  map[string]string
+	isBool bool
+	def    string // shown by -h
+}
+
+func (f *recordedFlag) String() string {
+	if f == nil || f.given == nil {
+		return ""
+	}
+	if value, ok := f.given[f.name]; ok {
+		return value
+	}
+	return f.def
+}
+
+func (f *recordedFlag) Set(value string) error {
+	f.given[f.name] = value
+	return nil
+}
+
+func (f *recordedFlag) IsBoolFlag() bool {
+	return f.isBool
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Writes a config file into a temporary directory and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chat.toml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	path := writeConfig(t, "port = 9001\nlog-file = \"from-file.txt\"\n")
+
+	settings, err := LoadServerSettings("server", nil)
+	if err != nil || settings.Port != defaultPort || settings.LogFile != logFileName {
+		t.Fatalf("defaults = %d %q, %v", settings.Port, settings.LogFile, err)
+	}
+
+	settings, err = LoadServerSettings("server", []string{"-config", path})
+	if err != nil || settings.Port != 9001 || settings.LogFile != "from-file.txt" {
+		t.Fatalf("config file = %d %q, %v", settings.Port, settings.LogFile, err)
+	}
+
+	t.Setenv("CHAT_PORT", "9002")
+	settings, err = LoadServerSettings("server", []string{"-config", path})
+	if err != nil || settings.Port != 9002 || settings.LogFile != "from-file.txt" {
+		t.Fatalf("environment over the config file = %d %q, %v", settings.Port, settings.LogFile, err)
+	}
+
+	settings, err = LoadServerSettings("server", []string{"-config", path, "-port", "9003"})
+	if err != nil || settings.Port != 9003 {
+		t.Fatalf("flag over the environment = %d, %v", settings.Port, err)
+	}
+
+	// The config file can be given by the environment too
+	t.Setenv("CHAT_CONFIG", path)
+	settings, err = LoadServerSettings("server", nil)
+	if err != nil || settings.LogFile != "from-file.txt" {
+		t.Fatalf("config file from CHAT_CONFIG = %q, %v", settings.LogFile, err)
+	}
+}
+
+func TestSettingsBoolFlags(t *testing.T) {
+	path := writeConfig(t, "ban-ip = true\n")
+
+	settings, err := LoadServerSettings("server", []string{"-config", path})
+	if err != nil || !settings.BanByIP {
+		t.Fatalf("ban-ip from the config file = %v, %v", settings.BanByIP, err)
+	}
+
+	t.Setenv("CHAT_BAN_IP", "false")
+	settings, err = LoadServerSettings("server", []string{"-config", path})
+	if err != nil || settings.BanByIP {
+		t.Fatalf("ban-ip from the environment = %v, %v", settings.BanByIP, err)
+	}
+
+	settings, err = LoadServerSettings("server", []string{"-config", path, "-ban-ip"})
+	if err != nil || !settings.BanByIP {
+		t.Fatalf("-ban-ip without a value = %v, %v", settings.BanByIP, err)
+	}
+}
+
+func TestConfigFileSideTables(t *testing.T) {
+	path := writeConfig(t, `
+port = 9001
+username = "alice"
+
+[server]
+port = 9100
+max-message-size = 8192
+
+[client]
+port = 9200
+known-hosts = "hosts"
+`)
+
+	server, err := LoadServerSettings("server", []string{"-config", path})
+	if err != nil {
+		t.Fatalf("LoadServerSettings: %v", err)
+	}
+	if server.Port != 9100 || server.MaxMessageSize != 8192 {
+		t.Errorf("server settings = port %d, max message size %d, want the [server] table", server.Port, server.MaxMessageSize)
+	}
+
+	client, err := LoadClientSettings("client", []string{"-config", path})
+	if err != nil {
+		t.Fatalf("LoadClientSettings: %v", err)
+	}
+	if client.Port != 9200 || client.Username != "alice" || client.KnownHostsFile != "hosts" {
+		t.Errorf("client settings = port %d, username %q, known hosts %q", client.Port, client.Username, client.KnownHostsFile)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown key", "prot = 9000\n", `unknown option "prot"`},
+		{"unknown key in the table", "[server]\nprot = 9000\n", `unknown server option "prot"`},
+		{"option of the other side in the table", "[server]\nusername = \"alice\"\n", `unknown server option "username"`},
+		{"table that is not a table", "server = 1\n", "server has to be a table"},
+		{"not a number", "port = \"high\"\n", "not a number"},
+		{"not a bool", "ban-ip = \"maybe\"\n", "not true or false"},
+		{"broken file", "port = \n", "unable to read config file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.content)
+			_, err := LoadServerSettings("server", []string{"-config", path})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadServerSettings = %v, want an error with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSettingsBadEnvironmentValue(t *testing.T) {
+	t.Setenv("CHAT_PORT", "high")
+	if _, err := LoadServerSettings("server", nil); err == nil || !strings.Contains(err.Error(), "CHAT_PORT") {
+		t.Fatalf("bad environment value = %v, want an error naming CHAT_PORT", err)
+	}
+}
+
+func TestSettingsBadFlags(t *testing.T) {
+	if _, err := LoadServerSettings("server", []string{"-port", "high"}); err == nil || !strings.Contains(err.Error(), "-port") {
+		t.Fatalf("bad flag value = %v, want an error naming -port", err)
+	}
+	if _, err := LoadServerSettings("server", []string{"extra"}); err == nil {
+		t.Fatal("a stray argument was accepted")
+	}
+}
+
+func TestSettingsReservedNames(t *testing.T) {
+	settings, err := LoadServerSettings("server", nil)
+	if err != nil || !reflect.DeepEqual(settings.reservedNames(), defaultReservedNames) {
+		t.Fatalf("default reserved names = %q, %v", settings.reservedNames(), err)
+	}
+
+	path := writeConfig(t, "reserved-names = [\"root\", \"staff\"]\n")
+	settings, err = LoadServerSettings("server", []string{"-config", path})
+	if err != nil || !reflect.DeepEqual(settings.reservedNames(), []string{"root", "staff"}) {
+		t.Fatalf("reserved names from a config file array = %q, %v", settings.reservedNames(), err)
+	}
+
+	settings, err = LoadServerSettings("server", []string{"-reserved-names", " root, ,ops "})
+	if err != nil || !reflect.DeepEqual(settings.reservedNames(), []string{"root", "ops"}) {
+		t.Fatalf("reserved names from a flag = %q, %v", settings.reservedNames(), err)
+	}
+
+	// An empty setting reserves no name, rather than falling back to the defaults
+	settings, err = LoadServerSettings("server", []string{"-reserved-names", ""})
+	if names := settings.reservedNames(); err != nil || names == nil || len(names) != 0 {
+		t.Fatalf("empty reserved names = %q, %v", names, err)
+	}
+}
@@ -1,42 +1,205 @@
 package internal
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 )
 
-// function to encrypt message to be sent
-func encrypt(msg string, key rsa.PublicKey) string {
+// Largest encoded message, in bytes, that either side will send or accept unless configured otherwise
+const defaultMaxMessageSize = 64 * 1024
+
+// Smallest limit either side can be configured with, the handshake messages carry public keys
+const minMaxMessageSize = 4 * 1024
+
+// Length of the symmetric session key, AES-256
+const sessionKeySize = 32
+
+var errMessageTooLarge = errors.New("message exceeds the maximum size")
+
+// Generates a random key for the symmetric session
+func newSessionKey() ([]byte, error) {
+	key := make([]byte, sessionKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Creates the AES-GCM cipher used for every message after the handshake
+func newSession(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Generates the token a client resumes its session with after the connection drops
+func newResumeToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// Hashes the key of a room with a new random salt, so the key itself is not kept
+func hashRoomKey(key string) ([]byte, []byte, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, nil, err
+	}
+	return salt, roomKeyDigest(salt, key), nil
+}
+
+// Returns the salted digest a room key is checked against
+func roomKeyDigest(salt []byte, key string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(key))
+	return h.Sum(nil)
+}
 
+// Encrypts a symmetric key with the receiver's public key, used for the key of a direct message
+func encryptSessionKey(key []byte, pub rsa.PublicKey) (string, error) {
 	label := []byte("OAEP Encrypted")
-	rng := rand.Reader
 
 	// * using OAEP algorithm to make it more secure
 	// * using sha256
-	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rng, &key, []byte(msg), label)
-	// check for errors
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &pub, key, label)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypts a symmetric key encrypted with encryptSessionKey
+func decryptSessionKey(cipherText string, priv *rsa.PrivateKey) ([]byte, error) {
+	ct, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil {
+		return nil, err
+	}
+	label := []byte("OAEP Encrypted")
+
+	// decrypting based on same parameters as encryption
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, ct, label)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != sessionKeySize {
+		return nil, fmt.Errorf("session key has invalid length %d", len(key))
+	}
+	return key, nil
+}
+
+// Encodes a public key so it can be sent in an envelope
+func encodePublicKey(pub *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// Decodes a public key received in an envelope
+func decodePublicKey(s string) (rsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
-		log.Fatalln("unable to encrypt")
+		return rsa.PublicKey{}, err
 	}
 
-	return base64.StdEncoding.EncodeToString(ciphertext)
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return rsa.PublicKey{}, err
+	}
+
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return rsa.PublicKey{}, errors.New("public key is not an RSA key")
+	}
+	return *pub, nil
+}
+
+// function to encrypt message to be sent
+// The output is the nonce followed by the sealed message
+func encrypt(msg []byte, session cipher.AEAD) ([]byte, error) {
+	nonce := make([]byte, session.NonceSize(), session.NonceSize()+len(msg)+session.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return session.Seal(nonce, nonce, msg, nil), nil
 }
 
 // function to decrypt message to be received
-func decrypt(cipherText string, key rsa.PrivateKey) string {
+func decrypt(cipherText []byte, session cipher.AEAD) ([]byte, error) {
+	if len(cipherText) < session.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
 
-	ct, _ := base64.StdEncoding.DecodeString(cipherText)
-	label := []byte("OAEP Encrypted")
-	rng := rand.Reader
+	nonce, sealed := cipherText[:session.NonceSize()], cipherText[session.NonceSize():]
+	return session.Open(nil, nonce, sealed, nil)
+}
 
-	// decrypting based on same parameters as encryption
-	plaintext, err := rsa.DecryptOAEP(sha256.New(), rng, &key, ct, label)
-	// check for errors
+// Encrypts a direct message to the public key of the recipient so that only the recipient can read it, not the server
+// A fresh key is wrapped with RSA-OAEP and the message is sealed with it, the result is "<wrapped key>.<sealed message>"
+func sealDirect(msg string, pub rsa.PublicKey) (string, error) {
+	key, err := newSessionKey()
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := encryptSessionKey(key, pub)
+	if err != nil {
+		return "", err
+	}
+
+	session, err := newSession(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := encrypt([]byte(msg), session)
+	if err != nil {
+		return "", err
+	}
+	return wrapped + "." + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a direct message sealed with sealDirect
+func openDirect(payload string, priv *rsa.PrivateKey) (string, error) {
+	wrapped, sealedText, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", errors.New("malformed direct message")
+	}
+
+	key, err := decryptSessionKey(wrapped, priv)
+	if err != nil {
+		return "", err
+	}
+
+	session, err := newSession(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(sealedText)
+	if err != nil {
+		return "", err
+	}
+
+	msg, err := decrypt(sealed, session)
 	if err != nil {
-		log.Fatalln(err)
+		return "", err
 	}
-	return string(plaintext)
+	return string(msg), nil
 }
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDirectMessages(t *testing.T) {
+	recipient, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := sealDirect("meet at noon", recipient.PublicKey)
+	if err != nil {
+		t.Fatalf("sealDirect: %v", err)
+	}
+	if strings.Contains(payload, "meet at noon") {
+		t.Fatal("the sealed message holds the text")
+	}
+
+	// Flips a bit of the sealed message, leaving the wrapped key as it is
+	wrapped, sealedText, _ := strings.Cut(payload, ".")
+	sealed, _ := base64.StdEncoding.DecodeString(sealedText)
+	sealed[len(sealed)-1] ^= 1
+	tampered := wrapped + "." + base64.StdEncoding.EncodeToString(sealed)
+
+	tests := []struct {
+		name    string
+		payload string
+		key     *rsa.PrivateKey
+		wantErr bool
+	}{
+		{"opened by the recipient", payload, recipient, false},
+		{"opened with the wrong key", payload, other, true},
+		{"tampered message", tampered, recipient, true},
+		{"message without its key", sealedText, recipient, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := openDirect(tt.payload, tt.key)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("openDirect = %q, want an error", msg)
+				}
+				return
+			}
+			if err != nil || msg != "meet at noon" {
+				t.Fatalf("openDirect = %q, %v", msg, err)
+			}
+		})
+	}
+}
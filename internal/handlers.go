@@ -0,0 +1,949 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Set the username of the client to a new username
+func (s *Server) handleName(cli *client, args []string) error {
+	oldName := cli.name()
+	newName := cleanName(args[0])
+
+	if account := cli.accountName(); account != "" {
+		return errDenied("You are logged in as " + account + ", account names can not be changed")
+	}
+	if err := validateName(newName, s.config.ReservedNames); err != nil {
+		return err
+	}
+	if s.accounts.exists(newName) {
+		return errNameRejected("username '" + newName + "' is registered, use /login to log in to it")
+	}
+	if err := s.reg.renameClient(cli, newName); err != nil {
+		return err
+	}
+
+	logText := oldName + " changed username to " + newName
+	s.writeLog(logText)
+	s.sendEnvelope(envelope{Type: msgUsername, Sender: newName, Payload: "You changed your name to: " + newName}, cli)
+	return nil
+}
+
+// Registers an account for the current username and logs the client in to it
+func (s *Server) handleRegister(cli *client, args []string) error {
+	if account := cli.accountName(); account != "" {
+		return errDenied("You are already logged in as " + account)
+	}
+
+	name := cli.name()
+	if err := s.accounts.register(name, args[0]); err != nil {
+		return err
+	}
+	if err := s.reg.login(cli, name); err != nil {
+		return err
+	}
+
+	logText := "'" + name + "'" + " REGISTERED AN ACCOUNT"
+	s.writeLog(logText)
+	s.sendNotice("Account registered, you are logged in as: "+name, cli)
+	return nil
+}
+
+// Logs the client in to an account. The client takes the account name as its username
+func (s *Server) handleLogin(cli *client, args []string) error {
+	accountName, err := s.accounts.authenticate(args[0], args[1])
+	if err != nil {
+		return errDenied(err.Error())
+	}
+
+	oldName := cli.name()
+	if err := s.reg.login(cli, accountName); err != nil {
+		return err
+	}
+
+	logText := "'" + oldName + "'" + " LOGGED IN AS " + "'" + accountName + "'"
+	s.writeLog(logText)
+	s.sendEnvelope(envelope{Type: msgUsername, Sender: accountName, Payload: "You are logged in as: " + accountName}, cli)
+	return nil
+}
+
+// Refuses DMs in plain text. The client seals a DM to the key of the receiver and sends it as a msgDirect envelope,
+// see relayDirect, so the server never sees the text. The command stays in the table for /help and its usage
+func (s *Server) handleMsg(cli *client, args []string) error {
+	return errDenied("The server does not relay DMs in plain text, seal the message to the key of " + args[0] + " and send it as a '" + msgDirect + "' envelope")
+}
+
+// Sends the message to all of the clients in the room, the focused room unless the message starts with #room_name
+func (s *Server) handleBroadcast(cli *client, args []string) error {
+	roomName, msg, err := s.messageRoom(cli, args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := s.broadcastMessage(cli, roomName, msg); err != nil {
+		return err
+	}
+
+	logText := "'" + cli.name() + "'" + " BROADCAST ->" + roomName + ":" + msg
+	s.writeLog(logText)
+	return nil
+}
+
+// Spams the message to the room 'N' times. The number of times is checked against the limit of the command
+func (s *Server) handleSpam(cli *client, args []string) error {
+	spamCount, _ := strconv.Atoi(args[0])
+	roomName, msg, err := s.messageRoom(cli, args[1])
+	if err != nil {
+		return err
+	}
+
+	// A mute or a kick while spamming stops it
+	for i := 0; i < spamCount; i++ {
+		if err := s.broadcastMessage(cli, roomName, msg); err != nil {
+			return err
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	logText := "'" + cli.name() + "'" + " SPAMMED " + msg + " " + args[0] + " Times"
+	s.writeLog(logText)
+	return nil
+}
+
+// Broadcast message all in capitals, to all users in the room
+func (s *Server) handleShout(cli *client, args []string) error {
+	roomName, msg, err := s.messageRoom(cli, args[0])
+	if err != nil {
+		return err
+	}
+	msg = strings.ToUpper(msg)
+
+	if err := s.broadcastMessage(cli, roomName, msg); err != nil {
+		return err
+	}
+
+	logText := "'" + cli.name() + "'" + " SHOUT ->" + roomName
+	s.writeLog(logText)
+	return nil
+}
+
+// Splits the room a message is for off the text. A message starting with #room_name goes to that room,
+// any other message to the room the client is focused on
+func (s *Server) messageRoom(cli *client, text string) (string, string, error) {
+	if strings.HasPrefix(text, "#") && len(text) > 1 {
+		roomName, msg, _ := strings.Cut(text[1:], " ")
+		msg = strings.TrimLeft(msg, " ")
+
+		if !s.reg.isMember(roomName, cli) {
+			return "", "", errNotFound("You are not in a room named: " + roomName)
+		}
+		if strings.TrimSpace(msg) == "" {
+			return "", "", &commandError{errCodeUsage, "missing message for #" + roomName}
+		}
+		return roomName, msg, nil
+	}
+
+	roomName := s.reg.activeRoom(cli)
+	if roomName == "" {
+		return "", "", errNotInRoom
+	}
+	return roomName, text, nil
+}
+
+// Create a new room specified by the name, the creator becomes its admin
+// With --key the room can only be joined with the secret that follows it
+func (s *Server) handleCreateRoom(cli *client, args []string) error {
+	roomName := args[0]
+
+	key := ""
+	if args[1] != "" {
+		if !strings.HasPrefix(args[1], "--key ") || strings.TrimSpace(strings.TrimPrefix(args[1], "--key ")) == "" {
+			return findCommand(cmdCreateRoom).usageError("the key has to be given as --key <secret>")
+		}
+		key = strings.TrimSpace(strings.TrimPrefix(args[1], "--key "))
+	}
+
+	if _, err := s.reg.createRoom(roomName, cli, key); err != nil {
+		return err
+	}
+
+	logText := "'" + cli.name() + "'" + " CREATED A ROOM ->" + "'" + roomName + "'"
+	if key != "" {
+		logText += " WITH A KEY"
+	}
+	s.writeLog(logText)
+
+	if key != "" {
+		s.sendNotice("Room created with name: "+roomName+", others join it with "+cmdJoinRoom+" "+roomName+" <key>", cli)
+		return nil
+	}
+	s.sendNotice("Room created with name: "+roomName, cli)
+	return nil
+}
+
+// Join a room specified by the room name and focus on it. The rooms the client is already in are kept
+// A room that does not exist is created with the joiner as admin if the server is configured to
+func (s *Server) handleJoinRoom(cli *client, args []string) error {
+	roomName := args[0]
+	if err := s.checkBan(roomName, cli); err != nil {
+		return err
+	}
+
+	created := false
+	if s.config.AutoCreateRooms && s.reg.room(roomName) == nil {
+		// Another client may create it first, then this one just joins
+		if _, err := s.reg.createRoom(roomName, cli, args[1]); err == nil {
+			created = true
+		}
+	}
+
+	err := s.reg.joinRoom(cli, roomName, args[1])
+	if err == errRoomNotFound {
+		return errNotFound("No such room: " + roomName + ", create it with " + cmdCreateRoom)
+	}
+	if err != nil {
+		return err
+	}
+
+	if created {
+		logText := "'" + cli.name() + "'" + " CREATED A ROOM ->" + "'" + roomName + "'"
+		s.writeLog(logText)
+	}
+	logText := "'" + cli.name() + "'" + " JOINED A ROOM ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	s.announceRoom(roomName, "'"+cli.name()+"' joined the room", cli)
+
+	if created {
+		s.sendNotice("Room created, you joined it as its admin: '"+roomName+"'", cli)
+		return nil
+	}
+	s.sendNotice("You joined a room: '"+roomName+"', your messages go to it now", cli)
+	return nil
+}
+
+// Quit the room specified by the name, or the focused room
+func (s *Server) handleQuitRoom(cli *client, args []string) error {
+	roomName, err := s.reg.quitRoom(cli, args[0])
+	if err != nil {
+		return err
+	}
+
+	logText := "'" + cli.name() + "'" + " QUITTED A ROOM ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	s.announceLeave(roomName, cli.name(), "")
+	s.handOver(roomName, cli.identity())
+
+	msg := "You quitted the room: '" + roomName + "'"
+	if active := s.reg.activeRoom(cli); active != "" {
+		msg += ", your messages go to '" + active + "'"
+	}
+	s.sendNotice(msg, cli)
+	return nil
+}
+
+// Focuses the client on one of its rooms, or lists its rooms if no room is given
+func (s *Server) handleSwitchRoom(cli *client, args []string) error {
+	if args[0] == "" {
+		rooms := s.reg.roomsOf(cli)
+		if len(rooms) == 0 {
+			return errNotInRoom
+		}
+		s.sendNotice("You are in "+quoteNames(rooms)+", your messages go to '"+s.reg.activeRoom(cli)+"'", cli)
+		return nil
+	}
+
+	if err := s.reg.focusRoom(cli, args[0]); err != nil {
+		return err
+	}
+	s.sendNotice("Your messages go to '"+args[0]+"' now", cli)
+	return nil
+}
+
+// Deletes the current room, given that the client is its admin. Everyone in it is told
+func (s *Server) handleDeleteRoom(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if !s.reg.isAdmin(currentRoom, cli) {
+		return errDenied("You have to be the admin of the room to delete it")
+	}
+
+	roomName := s.reg.roomName(currentRoom)
+	members, err := s.reg.deleteRoom(roomName)
+	if err != nil {
+		return err
+	}
+	if err := s.bans.deleteRoom(roomName); err != nil {
+		s.writeLog("Unable to save bans: " + err.Error())
+	}
+
+	logText := "'" + cli.name() + "'" + " DELETED A ROOM ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	for _, c := range members {
+		if c != cli {
+			s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: "The room was deleted by " + cli.name()}, c)
+		}
+	}
+	s.sendNotice("You deleted the room: '"+roomName+"'", cli)
+	return nil
+}
+
+// Renames the current room, given that the client is its admin
+func (s *Server) handleRenameRoom(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if !s.reg.isAdmin(currentRoom, cli) {
+		return errDenied("You have to be the admin of the room to rename it")
+	}
+
+	oldName, newName := s.reg.roomName(currentRoom), args[0]
+	if err := s.reg.renameRoom(oldName, newName); err != nil {
+		return err
+	}
+	if err := s.bans.renameRoom(oldName, newName); err != nil {
+		s.writeLog("Unable to save bans: " + err.Error())
+	}
+
+	logText := "'" + cli.name() + "'" + " RENAMED A ROOM ->" + "'" + oldName + "'" + " TO " + "'" + newName + "'"
+	s.writeLog(logText)
+
+	s.announceRoom(newName, "The room '"+oldName+"' was renamed to '"+newName+"' by "+cli.name(), cli)
+	s.sendNotice("You renamed the room '"+oldName+"' to '"+newName+"'", cli)
+	return nil
+}
+
+// Makes a member of the current room its admin, given that the client is the admin. The old admin stays a mod
+func (s *Server) handleTransfer(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	newAdmin := s.reg.client(args[0])
+
+	if newAdmin == nil {
+		return errNotFound("No such user: " + args[0])
+	}
+	if !s.reg.isAdmin(currentRoom, cli) {
+		return errDenied("You have to be the admin of the room to transfer it")
+	}
+	roomName := s.reg.roomName(currentRoom)
+	if !s.reg.isMember(roomName, newAdmin) {
+		return errNotFound(newAdmin.name() + " is not in the room")
+	}
+	if newAdmin == cli {
+		return &commandError{errCodeUsage, "You are already the admin of the room"}
+	}
+
+	s.reg.transfer(currentRoom, newAdmin)
+
+	logText := "'" + cli.name() + "'" + " TRANSFERRED ROOM ->" + "'" + roomName + "'" + " TO " + "'" + newAdmin.name() + "'"
+	s.writeLog(logText)
+
+	s.announceRoom(roomName, "'"+newAdmin.name()+"' is the admin of the room now, given by "+cli.name(), newAdmin)
+	s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: cli.name() + " made you the admin of the room"}, newAdmin)
+	return nil
+}
+
+// Promotes a member of the room, given that the promoter is the admin of the room
+func (s *Server) handlePromote(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	toPromote := s.reg.client(args[0])
+
+	if toPromote == nil {
+		return errNotFound("No such user: " + args[0])
+	}
+	if !s.reg.isAdmin(currentRoom, cli) {
+		return errDenied("You have to be the admin of the room to promote")
+	}
+	roomName := s.reg.roomName(currentRoom)
+	if !s.reg.isMember(roomName, toPromote) {
+		return errNotFound(toPromote.name() + " is not in the room")
+	}
+	if s.reg.isMod(currentRoom, toPromote) {
+		return &commandError{errCodeUsage, toPromote.name() + " is already a mod of the room"}
+	}
+
+	s.reg.promote(currentRoom, toPromote)
+
+	logText := "'" + toPromote.name() + "'" + " PROMOTED TO A MOD BY->" + "'" + cli.name() + "'" + " FOR ROOM -> " + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	s.sendNotice("You have been promoted to a moderator by: "+cli.name(), toPromote)
+	return nil
+}
+
+// Takes the mod rights of a user in the room away, given that the demoter is the admin of the room
+// Accounts can be demoted while they are offline
+func (s *Server) handleDemote(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if !s.reg.isAdmin(currentRoom, cli) {
+		return errDenied("You have to be the admin of the room to demote")
+	}
+	roomName := s.reg.roomName(currentRoom)
+
+	toDemote, name, identity, err := s.findUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := s.reg.demote(currentRoom, identity); err != nil {
+		return err
+	}
+
+	logText := "'" + name + "'" + " DEMOTED BY->" + "'" + cli.name() + "'" + " FOR ROOM -> " + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	if toDemote != nil {
+		s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: "You are no longer a moderator, demoted by: " + cli.name()}, toDemote)
+	}
+	s.sendNotice(name+" is no longer a mod of '"+roomName+"'", cli)
+	return nil
+}
+
+// Lists the admin and the mods of a room, the current room if no room is given
+func (s *Server) handleMods(cli *client, args []string) error {
+	roomName := args[0]
+	if roomName == "" {
+		if roomName = s.reg.activeRoom(cli); roomName == "" {
+			return errNotInRoom
+		}
+	}
+	rm := s.reg.room(roomName)
+	if rm == nil {
+		return errNotFound("No such room: " + roomName)
+	}
+
+	admin, mods := s.reg.staff(rm)
+	var modNames []string
+	for _, id := range mods {
+		if id != admin {
+			modNames = append(modNames, s.identityName(id))
+		}
+	}
+
+	msg := "Staff of '" + roomName + "': admin "
+	if admin == "" {
+		msg += "none"
+	} else {
+		msg += "'" + s.identityName(admin) + "'"
+	}
+	if len(modNames) == 0 {
+		msg += ", no mods"
+	} else {
+		msg += ", mods " + quoteNames(modNames)
+	}
+	s.sendNotice(msg, cli)
+	return nil
+}
+
+// Finds a user by name, connected or, for accounts, offline
+// Returns the client if it is connected, the name of the user and the identity room rights are given to
+func (s *Server) findUser(name string) (*client, string, string, error) {
+	if c := s.reg.client(name); c != nil {
+		return c, c.name(), c.identity(), nil
+	}
+	if account := s.accounts.registeredName(name); account != "" {
+		return nil, account, accountIdentity(account), nil
+	}
+	return nil, "", "", errNotFound("No such user: " + name)
+}
+
+// Returns the name to show for an identity holding rights in a room
+func (s *Server) identityName(identity string) string {
+	if name := s.reg.identityName(identity); name != "" {
+		return name
+	}
+	if strings.HasPrefix(identity, accountIdentity("")) {
+		if name := s.accounts.registeredName(strings.TrimPrefix(identity, accountIdentity(""))); name != "" {
+			return name
+		}
+	}
+	return "a guest who left"
+}
+
+// Kicks a user out of the current room, telling them and the room the reason if one is given
+// Users can only kick users of a lower rank, so the admin kicks mods and members and mods kick members
+// The kicked user can not join the room again until the kick cooldown is over
+func (s *Server) handleKick(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	toKick, reason := s.reg.client(args[0]), args[1]
+
+	if toKick == nil {
+		return errNotFound("No such user: " + args[0])
+	}
+	if currentRoom == nil {
+		return errNotInRoom
+	}
+	if rank := s.reg.rank(currentRoom, cli); rank < rankMod || rank <= s.reg.rank(currentRoom, toKick) {
+		return errDenied("You are not allowed to kick " + toKick.name())
+	}
+	if !s.reg.kick(currentRoom, toKick, s.config.KickCooldown) {
+		return errNotFound(toKick.name() + " is not in the room")
+	}
+
+	roomName := s.reg.roomName(currentRoom)
+	logText := "'" + cli.name() + "'" + " KICKED " + "'" + toKick.name() + "'" + " FROM ROOM ->" + "'" + roomName + "'"
+	if reason != "" {
+		logText += " REASON: " + reason
+	}
+	s.writeLog(logText)
+
+	msg := "You have been kicked from the room by: " + cli.name()
+	announcement := "'" + toKick.name() + "' was kicked by " + cli.name()
+	if reason != "" {
+		msg += ", reason: " + reason
+		announcement += ", reason: " + reason
+	}
+	if s.config.KickCooldown > 0 {
+		msg += ". You can join it again in " + s.config.KickCooldown.String()
+	}
+
+	s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: msg}, toKick)
+	s.announceRoom(roomName, announcement, toKick)
+	if s.config.KickCooldown > 0 && toKick.accountName() == "" {
+		s.sendNotice(toKick.name()+" is a guest, the cooldown only holds until they reconnect", cli)
+	}
+	return nil
+}
+
+// Bans a user from the current room, until the duration is over if one is given. Users can only ban users of a lower rank
+// A banned user in the room is taken out of it. Accounts can be banned while they are offline
+func (s *Server) handleBan(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if currentRoom == nil {
+		return errNotInRoom
+	}
+
+	// The duration is optional, a second word that is not one starts the reason
+	duration, timed := parseDuration(args[1])
+	reason := args[2]
+	if !timed && args[1] != "" {
+		reason = strings.TrimSpace(args[1] + " " + args[2])
+	}
+
+	target, name, identity, err := s.findUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	if rank := s.reg.rank(currentRoom, cli); rank < rankMod || rank <= s.reg.identityRank(currentRoom, identity) {
+		return errDenied("You are not allowed to ban " + name)
+	}
+
+	roomName := s.reg.roomName(currentRoom)
+	b := ban{Room: roomName, Identity: identity, Name: name, Reason: reason, By: cli.name(), Created: time.Now().UTC()}
+	if timed {
+		expires := b.Created.Add(duration)
+		b.Expires = &expires
+	}
+	// A guest id does not outlast the connection, so guests are always banned by their IP address too
+	if target != nil && (s.config.BanByIP || target.accountName() == "") {
+		b.IP = remoteIP(target.conn)
+	}
+	if err := s.bans.add(b); err != nil {
+		return err
+	}
+
+	logText := "'" + cli.name() + "'" + " BANNED " + "'" + name + "'" + " FROM ROOM ->" + "'" + roomName + "'"
+	if timed {
+		logText += " FOR " + duration.String()
+	}
+	if reason != "" {
+		logText += " REASON: " + reason
+	}
+	s.writeLog(logText)
+
+	announcement := "'" + name + "' was banned by " + cli.name() + describeBan(b)
+	if target != nil && s.reg.kick(currentRoom, target, 0) {
+		s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: "You have been banned from the room by: " + cli.name() + describeBan(b)}, target)
+	}
+	s.announceRoom(roomName, announcement, target)
+	return nil
+}
+
+// Lifts the ban of a user from the current room. Like bans, users can only lift the bans of users of a lower rank
+func (s *Server) handleUnban(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if !s.reg.isMod(currentRoom, cli) {
+		return errDenied("You have to be a mod of the room to unban")
+	}
+
+	roomName := s.reg.roomName(currentRoom)
+	b, banned := s.findBan(roomName, args[0])
+	if !banned {
+		return errNotFound(args[0] + " is not banned from the room")
+	}
+	if s.reg.rank(currentRoom, cli) <= s.reg.identityRank(currentRoom, b.Identity) {
+		return errDenied("You are not allowed to unban " + b.Name)
+	}
+	found, err := s.bans.remove(b)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errNotFound(args[0] + " is not banned from the room")
+	}
+
+	logText := "'" + cli.name() + "'" + " UNBANNED " + "'" + args[0] + "'" + " FROM ROOM ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	s.sendNotice(args[0]+" can join '"+roomName+"' again", cli)
+	return nil
+}
+
+// Returns the ban of the user with the name in the room
+// Connected users and accounts are looked up first, guests who left by the name they were banned with
+// Guest bans kept over a restart have no identity left and are only found by that name
+func (s *Server) findBan(roomName string, name string) (ban, bool) {
+	if _, _, identity, err := s.findUser(name); err == nil {
+		for _, b := range s.bans.list(roomName) {
+			if b.Identity == identity {
+				return b, true
+			}
+		}
+	}
+	for _, b := range s.bans.list(roomName) {
+		if nameKey(b.Name) == nameKey(name) {
+			return b, true
+		}
+	}
+	return ban{}, false
+}
+
+// Lists the bans of the current room, given that the client is a mod of the room
+func (s *Server) handleBans(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if !s.reg.isMod(currentRoom, cli) {
+		return errDenied("You have to be a mod of the room to see its bans")
+	}
+	roomName := s.reg.roomName(currentRoom)
+
+	bans := s.bans.list(roomName)
+	if len(bans) == 0 {
+		s.sendNotice("Nobody is banned from '"+roomName+"'", cli)
+		return nil
+	}
+
+	lines := []string{"Bans in '" + roomName + "':"}
+	for _, b := range bans {
+		lines = append(lines, "'"+b.Name+"' by "+b.By+describeBan(b))
+	}
+	s.sendNotice(strings.Join(lines, "\n"), cli)
+	return nil
+}
+
+// Refuses the client if it is banned from the room. Staff of the room are never kept out by the IP address of someone else
+func (s *Server) checkBan(roomName string, cli *client) error {
+	ip := remoteIP(cli.conn)
+	if s.reg.isMod(s.reg.room(roomName), cli) {
+		ip = ""
+	}
+
+	b, banned := s.bans.find(roomName, cli.identity(), ip)
+	if !banned {
+		return nil
+	}
+	return errDenied("You are banned from the room" + describeBan(b))
+}
+
+// Describes how long a ban lasts and why, for notices
+func describeBan(b ban) string {
+	text := ", permanently"
+	if b.Expires != nil {
+		text = ", until " + b.Expires.Format("2006-01-02 15:04 MST")
+	}
+	if b.Reason != "" {
+		text += ", reason: " + b.Reason
+	}
+	return text
+}
+
+// Keeps a user from talking in the current room, for the duration if one is given. They can still read it
+// Users can only mute users of a lower rank
+func (s *Server) handleMute(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if currentRoom == nil {
+		return errNotInRoom
+	}
+
+	var duration time.Duration
+	if args[1] != "" {
+		var ok bool
+		if duration, ok = parseDuration(args[1]); !ok {
+			return findCommand(cmdMute).usageError("duration must be like 30m, 2h or 7d")
+		}
+	}
+
+	target, name, identity, err := s.findUser(args[0])
+	if err != nil {
+		return err
+	}
+	if rank := s.reg.rank(currentRoom, cli); rank < rankMod || rank <= s.reg.identityRank(currentRoom, identity) {
+		return errDenied("You are not allowed to mute " + name)
+	}
+
+	var until time.Time
+	howLong := ""
+	if duration > 0 {
+		until = time.Now().Add(duration)
+		howLong = " for " + duration.String()
+	}
+	s.reg.mute(currentRoom, identity, until)
+
+	roomName := s.reg.roomName(currentRoom)
+	logText := "'" + cli.name() + "'" + " MUTED " + "'" + name + "'" + " IN ROOM ->" + "'" + roomName + "'" + strings.ToUpper(howLong)
+	s.writeLog(logText)
+
+	if target != nil {
+		s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: "You have been muted by " + cli.name() + howLong + ", you can still read the room"}, target)
+	}
+	s.announceRoom(roomName, "'"+name+"' was muted by "+cli.name()+howLong, target)
+	if target != nil && target.accountName() == "" {
+		s.sendNotice(name+" is a guest, the mute only holds until they reconnect", cli)
+	}
+	return nil
+}
+
+// Lets a muted user talk in the current room again, given that the client ranks above them
+func (s *Server) handleUnmute(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if currentRoom == nil {
+		return errNotInRoom
+	}
+
+	target, name, identity, err := s.findUser(args[0])
+	if err != nil {
+		return err
+	}
+	if rank := s.reg.rank(currentRoom, cli); rank < rankMod || rank <= s.reg.identityRank(currentRoom, identity) {
+		return errDenied("You are not allowed to unmute " + name)
+	}
+	if !s.reg.unmute(currentRoom, identity) {
+		return errNotFound(name + " is not muted in the room")
+	}
+
+	roomName := s.reg.roomName(currentRoom)
+	logText := "'" + cli.name() + "'" + " UNMUTED " + "'" + name + "'" + " IN ROOM ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	if target != nil {
+		s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: "You can talk in the room again, unmuted by " + cli.name()}, target)
+	}
+	s.sendNotice(name+" can talk in '"+roomName+"' again", cli)
+	return nil
+}
+
+// Turns the moderated mode of the current room on or off, or tells whether it is on. Changing it takes a mod
+// While it is on only mods and voiced users can talk in the room
+func (s *Server) handleModerated(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if currentRoom == nil {
+		return errNotInRoom
+	}
+
+	roomName := s.reg.roomName(currentRoom)
+	var on bool
+	switch strings.ToLower(args[0]) {
+	case "":
+		state := "not moderated"
+		if s.reg.isModerated(currentRoom) {
+			state = "moderated, only mods and voiced users can talk"
+		}
+		s.sendNotice("The room '"+roomName+"' is "+state, cli)
+		return nil
+	case "on":
+		on = true
+	case "off":
+		on = false
+	default:
+		return findCommand(cmdModerated).usageError("the mode must be on or off")
+	}
+
+	if !s.reg.isMod(currentRoom, cli) {
+		return errDenied("You have to be a mod of the room to change its mode")
+	}
+	s.reg.setModerated(currentRoom, on)
+
+	logText := "'" + cli.name() + "'" + " SET MODERATED " + strings.ToUpper(args[0]) + " FOR ROOM ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	if on {
+		s.announceRoom(roomName, "The room is moderated now, only mods and voiced users can talk. Set by "+cli.name(), nil)
+	} else {
+		s.announceRoom(roomName, "The room is no longer moderated, everyone can talk. Set by "+cli.name(), nil)
+	}
+	return nil
+}
+
+// Invites a connected user to the current room, given that the client is a mod of the room
+// The invitation lets the user join once without the key, also while the room is invite only, until it expires
+func (s *Server) handleInvite(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if !s.reg.isMod(currentRoom, cli) {
+		return errDenied("You have to be a mod of the room to invite users")
+	}
+
+	target := s.reg.client(args[0])
+	if target == nil {
+		return errNotFound("No user named: " + args[0])
+	}
+	roomName := s.reg.roomName(currentRoom)
+	if s.reg.isMember(roomName, target) {
+		return &commandError{errCodeUsage, target.name() + " is already in the room"}
+	}
+
+	ttl := s.config.InviteTTL
+	s.reg.invite(currentRoom, target.identity(), time.Now().Add(ttl))
+
+	logText := "'" + cli.name() + "'" + " INVITED " + "'" + target.name() + "'" + " TO ROOM ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	invitation := cli.name() + " invited you to '" + roomName + "', join it with " + cmdJoinRoom + " " + roomName + " within " + ttl.String()
+	s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: invitation}, target)
+	s.sendNotice(target.name()+" is invited to '"+roomName+"' for "+ttl.String(), cli)
+	return nil
+}
+
+// Shows or sets whether only invited users can join the current room. Only mods of the room can set it
+func (s *Server) handleInviteOnly(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if currentRoom == nil {
+		return errNotInRoom
+	}
+
+	roomName := s.reg.roomName(currentRoom)
+	var on bool
+	switch strings.ToLower(args[0]) {
+	case "":
+		state := "open to everyone"
+		if s.reg.isInviteOnly(currentRoom) {
+			state = "invite only"
+		}
+		s.sendNotice("The room '"+roomName+"' is "+state, cli)
+		return nil
+	case "on":
+		on = true
+	case "off":
+		on = false
+	default:
+		return findCommand(cmdInviteOnly).usageError("the mode must be on or off")
+	}
+
+	if !s.reg.isMod(currentRoom, cli) {
+		return errDenied("You have to be a mod of the room to change its mode")
+	}
+	s.reg.setInviteOnly(currentRoom, on)
+
+	logText := "'" + cli.name() + "'" + " SET INVITE ONLY " + strings.ToUpper(args[0]) + " FOR ROOM ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	if on {
+		s.announceRoom(roomName, "The room is invite only now, users need an invitation to join. Set by "+cli.name(), nil)
+	} else {
+		s.announceRoom(roomName, "The room is no longer invite only. Set by "+cli.name(), nil)
+	}
+	return nil
+}
+
+// Lets a user talk in the current room while it is moderated, given that the client is a mod of the room
+func (s *Server) handleVoice(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if !s.reg.isMod(currentRoom, cli) {
+		return errDenied("You have to be a mod of the room to give voice")
+	}
+
+	target, name, identity, err := s.findUser(args[0])
+	if err != nil {
+		return err
+	}
+	if !s.reg.voice(currentRoom, identity) {
+		return &commandError{errCodeUsage, name + " already has voice in the room"}
+	}
+
+	roomName := s.reg.roomName(currentRoom)
+	logText := "'" + cli.name() + "'" + " VOICED " + "'" + name + "'" + " IN ROOM ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	if target != nil {
+		s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: cli.name() + " gave you voice, you can talk while the room is moderated"}, target)
+	}
+	s.sendNotice(name+" has voice in '"+roomName+"'", cli)
+	return nil
+}
+
+// Takes the voice of a user in the current room away, given that the client is a mod of the room
+func (s *Server) handleDevoice(cli *client, args []string) error {
+	currentRoom := s.reg.room(s.reg.activeRoom(cli))
+	if !s.reg.isMod(currentRoom, cli) {
+		return errDenied("You have to be a mod of the room to take voice away")
+	}
+
+	target, name, identity, err := s.findUser(args[0])
+	if err != nil {
+		return err
+	}
+	if !s.reg.devoice(currentRoom, identity) {
+		return errNotFound(name + " has no voice in the room")
+	}
+
+	roomName := s.reg.roomName(currentRoom)
+	logText := "'" + cli.name() + "'" + " DEVOICED " + "'" + name + "'" + " IN ROOM ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	if target != nil {
+		s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: cli.name() + " took your voice away"}, target)
+	}
+	s.sendNotice(name+" no longer has voice in '"+roomName+"'", cli)
+	return nil
+}
+
+// Lists the active users, or the active users in a room if a room name is given
+func (s *Server) handleList(cli *client, args []string) error {
+	var activeUsers string
+	if args[0] == "" {
+		for _, c := range s.reg.clientList() {
+			activeUsers += "'" + c.name() + "'" + " "
+		}
+
+		s.sendNotice("Active users are: "+activeUsers, cli)
+		return nil
+	}
+
+	if s.reg.room(args[0]) == nil {
+		return errNotFound("No such room: " + args[0])
+	}
+	for _, c := range s.reg.roomClients(args[0]) {
+		activeUsers += "'" + c.name() + "'" + " "
+	}
+
+	s.sendNotice("Active users in '"+args[0]+"' are: "+activeUsers, cli)
+	return nil
+}
+
+// Lists the active rooms for the server
+func (s *Server) handleListRooms(cli *client, args []string) error {
+	var activeRooms string
+	for _, name := range s.reg.roomNames() {
+		activeRooms += "'" + name + "'" + " "
+	}
+	s.sendNotice("Active rooms are: "+activeRooms, cli)
+	return nil
+}
+
+// Sends the usage line of every command. The terminal client prints its own help, this is for other clients
+func (s *Server) handleHelp(cli *client, args []string) error {
+	var lines []string
+	for _, c := range commands {
+		lines = append(lines, c.usage()+" ("+c.description+")")
+	}
+	s.sendNotice(strings.Join(lines, "\n"), cli)
+	return nil
+}
+
+// Returns the names quoted and separated by commas, for notices
+func quoteNames(names []string) string {
+	return "'" + strings.Join(names, "', '") + "'"
+}
+
+// Disconnects from the server
+func (s *Server) handleExit(cli *client, args []string) error {
+	return errClientExit
+}
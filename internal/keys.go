@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Size of the server identity key generated on first run
+const serverKeyBits = 2048
+
+// Returned when the server presents a different key than the one recorded for its address
+var errHostKeyChanged = errors.New("server key changed")
+
+// Loads the server identity key from a PEM file, or generates one and writes it to the file if it does not exist yet
+// PKCS#1 "RSA PRIVATE KEY" and PKCS#8 "PRIVATE KEY" blocks are both accepted
+func LoadOrCreateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM block", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s does not contain an RSA key", path)
+		}
+		return rsaKey, nil
+	default:
+		return nil, fmt.Errorf("%s contains an unsupported %q block", path, block.Type)
+	}
+}
+
+// Generates a new identity key and saves it so the server keeps it across restarts
+func createKey(path string) (*rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, serverKeyBits)
+	if err != nil {
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := writeFileAtomic(path, data); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Returns the fingerprint of a public key in the same form as OpenSSH, SHA256 of the key followed by base64
+func fingerprint(pub *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Returns the file the client records server fingerprints in, ~/.chat_server/known_hosts
+func knownHostsPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".chat_server", "known_hosts"), nil
+}
+
+// Compares the fingerprint of the server at the address with the one recorded in the known hosts file
+// An address seen for the first time is recorded and reported with known set to false
+// A different fingerprint returns errHostKeyChanged, the file is not changed in that case
+func checkKnownHost(path string, addr string, fp string) (known bool, err error) {
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	if f != nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 || fields[0] != addr {
+				continue
+			}
+
+			f.Close()
+			if fields[1] != fp {
+				return true, errHostKeyChanged
+			}
+			return true, nil
+		}
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return false, err
+		}
+	}
+
+	// Trust on first use, the fingerprint is pinned for every later connection
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, err
+	}
+	out, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer out.Close()
+
+	_, err = fmt.Fprintln(out, addr, fp)
+	return false, err
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckKnownHost(t *testing.T) {
+	// The file does not exist yet, so its directory is created on first use too
+	path := filepath.Join(t.TempDir(), ".chat_server", "known_hosts")
+
+	steps := []struct {
+		name      string
+		addr      string
+		fp        string
+		wantKnown bool
+		wantErr   error
+	}{
+		{"first use records the key", "localhost:8080", "SHA256:first", false, nil},
+		{"the same key is accepted", "localhost:8080", "SHA256:first", true, nil},
+		{"a changed key is refused", "localhost:8080", "SHA256:other", true, errHostKeyChanged},
+		{"another address is recorded on its own", "example.com:8080", "SHA256:other", false, nil},
+		{"the first address still has its key", "localhost:8080", "SHA256:first", true, nil},
+	}
+
+	for _, step := range steps {
+		before, _ := os.ReadFile(path)
+		known, err := checkKnownHost(path, step.addr, step.fp)
+		if known != step.wantKnown || err != step.wantErr {
+			t.Fatalf("%s: checkKnownHost = %v, %v, want %v, %v", step.name, known, err, step.wantKnown, step.wantErr)
+		}
+
+		after, readErr := os.ReadFile(path)
+		if readErr != nil {
+			t.Fatalf("%s: %v", step.name, readErr)
+		}
+		if changed := string(after) != string(before); changed != (!step.wantKnown) {
+			t.Fatalf("%s: known hosts file went from %q to %q", step.name, before, after)
+		}
+	}
+}
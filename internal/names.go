@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Longest username accepted, in characters
+const maxNameLength = 32
+
+// Usernames nobody can take unless the config sets its own list
+var defaultReservedNames = []string{"SERVER", "admin", "moderator", "system"}
+
+// Folds case so that names differing only in case are treated as the same name
+var nameFolder = cases.Fold()
+
+// Returns the name in the form it is shown, normalized to NFC and trimmed
+func cleanName(name string) string {
+	return norm.NFC.String(strings.TrimSpace(name))
+}
+
+// Returns the key a name is registered under. Names with the same key are the same user,
+// so "Alice", "ALICE" and a compatibility spelling of the same letters all collide
+func nameKey(name string) string {
+	return norm.NFKC.String(nameFolder.String(norm.NFKC.String(cleanName(name))))
+}
+
+// Checks that the name can be used as a username and returns the reason if it can not
+// Names are 1 to maxNameLength letters, digits, '_', '-' or '.', and may not be one of the reserved names
+func validateName(name string, reserved []string) error {
+	name = cleanName(name)
+
+	if name == "" {
+		return errNameRejected("username can not be empty")
+	}
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return errNameRejected("username can be at most " + strconv.Itoa(maxNameLength) + " characters")
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' && r != '.' {
+			return errNameRejected("username can only contain letters, digits, '_', '-' and '.'")
+		}
+	}
+
+	key := nameKey(name)
+	for _, r := range reserved {
+		if nameKey(r) == key {
+			return errNameRejected("username '" + name + "' is reserved")
+		}
+	}
+	return nil
+}
+
+// Creates an error telling the client why their username was not accepted
+func errNameRejected(reason string) error {
+	return &commandError{errCodeNameRejected, reason}
+}
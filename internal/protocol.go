@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Version of the wire protocol, sent in every envelope
+const protocolVersion = 1
+
+// Envelope types
+// The handshake types are sent in plain text, everything after the handshake is encrypted with the session keys
+const (
+	msgHello    string = "hello"    // client -> server, username and client public key
+	msgKey      string = "key"      // server -> client, server public key
+	msgSession  string = "session"  // client -> server -> client, ephemeral X25519 keys, the server one signed with the server key
+	msgRekey    string = "rekey"    // client -> server -> client, ephemeral X25519 keys for the next epoch, sent encrypted
+	msgCommand  string = "command"  // client -> server, a slash command and its arguments
+	msgUsername string = "username" // server -> client, the username registered for the connection, sent after the handshake and /name
+	msgChat     string = "chat"     // server -> client, message sent to a room
+	msgNotice   string = "notice"   // server -> client, information from the server
+	msgError    string = "error"    // server -> client, a request failed
+	msgShutdown string = "shutdown" // server -> client, the server is going down, the connection closes on purpose
+	msgResume   string = "resume"   // client -> server, token of a dropped connection, sent once the session is agreed if the hello asked to resume
+	msgPing     string = "ping"     // either way, asks the other side to answer with a pong so an idle connection is known to be alive
+	msgPong     string = "pong"     // either way, the answer to a ping
+
+	// End to end encrypted direct messages, the server only relays keys and ciphertext it can not read
+	msgKeyRequest string = "key_request" // client -> server, asks for the public key of the user named in the payload
+	msgPublicKey  string = "public_key"  // server -> client, public key of the sender, empty if there is no such user
+	msgDirect     string = "direct"      // client -> server -> client, message sealed to the public key of the recipient
+)
+
+// Every frame on the wire is a 4 byte big endian length followed by one envelope encoded as JSON
+type envelope struct {
+	Version   int       `json:"v"`
+	Type      string    `json:"type"`
+	ID        uint64    `json:"id"`
+	Timestamp time.Time `json:"ts"`
+	Sender    string    `json:"from,omitempty"`
+	Room      string    `json:"room,omitempty"`
+	To        string    `json:"to,omitempty"` // recipient of a direct message
+	Command   string    `json:"cmd,omitempty"`
+	Args      []string  `json:"args,omitempty"`
+	Payload   string    `json:"payload,omitempty"`
+	Code      string    `json:"code,omitempty"`   // set on error envelopes
+	Signature string    `json:"sig,omitempty"`    // set on the session envelope of the server
+	Token     string    `json:"token,omitempty"`  // resume token, handed out on the username envelope and sent back on resume
+	Resume    bool      `json:"resume,omitempty"` // set on the hello of a client that reconnects
+}
+
+// Size of the length prefix of a frame
+const frameHeaderSize = 4
+
+var lastMessageID uint64
+
+// Returns a new id for an outgoing envelope
+func nextMessageID() uint64 {
+	return atomic.AddUint64(&lastMessageID, 1)
+}
+
+// Writes one length prefixed frame. The header and body are written in a single call
+// so frames from different goroutines never interleave on the same connection
+func writeFrame(w io.Writer, data []byte, maxSize int) error {
+	if len(data) > maxFrameSize(maxSize) {
+		return errMessageTooLarge
+	}
+
+	buf := make([]byte, frameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[frameHeaderSize:], data)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// Reads one length prefixed frame, refusing frames over the size limit
+func readFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	// The body of a frame over the limit is skipped so the next frame can still be read,
+	// the two sides may be configured with different limits
+	size := binary.BigEndian.Uint32(header[:])
+	if size > uint32(maxFrameSize(maxSize)) {
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return nil, err
+		}
+		return nil, errMessageTooLarge
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Largest frame accepted on the wire, the largest encoded message plus the encryption overhead
+func maxFrameSize(maxSize int) int {
+	return maxSize + 1024
+}
+
+// Fills in the protocol fields, encodes and encrypts the envelope and writes it as one frame
+// Nil session keys send the envelope in plain text, which is only used during the handshake
+// Envelopes that encode to more than maxSize bytes are refused with errMessageTooLarge
+func writeEnvelope(w io.Writer, env envelope, session *sessionKeys, maxSize int) error {
+	env.Version = protocolVersion
+	env.ID = nextMessageID()
+	env.Timestamp = time.Now().UTC()
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxSize {
+		return errMessageTooLarge
+	}
+
+	if session != nil {
+		session.writeMu.Lock()
+		defer session.writeMu.Unlock()
+
+		data, err = session.seal(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFrame(w, data, maxSize)
+}
+
+// Reads one frame, decrypts it with the session keys if there are any and decodes the envelope
+func readEnvelope(r io.Reader, session *sessionKeys, maxSize int) (envelope, error) {
+	data, err := readFrame(r, maxSize)
+	if err != nil {
+		return envelope{}, err
+	}
+	return decodeEnvelope(data, session, maxSize)
+}
+
+// Decrypts and decodes the body of a frame
+// A frame that fails here can be skipped, the stream itself is still in sync
+func decodeEnvelope(data []byte, session *sessionKeys, maxSize int) (envelope, error) {
+	var env envelope
+
+	if session != nil {
+		var err error
+		data, err = session.open(data)
+		if err != nil {
+			return env, err
+		}
+	}
+	if len(data) > maxSize {
+		return env, errMessageTooLarge
+	}
+
+	if err := json.Unmarshal(data, &env); err != nil {
+		return env, err
+	}
+	if env.Version != protocolVersion {
+		return env, fmt.Errorf("unsupported protocol version %d", env.Version)
+	}
+	return env, nil
+}
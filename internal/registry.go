@@ -0,0 +1,984 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Errors returned by the registry
+var (
+	errNameTaken       error = &commandError{errCodeNameRejected, "username is already taken"}
+	errAccountLoggedIn       = errors.New("that account is already logged in")
+	errRoomExists            = errors.New("room already exists")
+	errRoomNotFound    error = &commandError{errCodeNotFound, "No such room"}
+	errAlreadyMember   error = &commandError{errCodeUsage, "You are already in that room"}
+	errNotInRoom       error = &commandError{errCodeUsage, "You are not in a room"}
+	errNotMember       error = &commandError{errCodeUsage, "You are not in that room"}
+	errNotMod          error = &commandError{errCodeUsage, "That user is not a mod of the room"}
+	errDemoteAdmin     error = &commandError{errCodeDenied, "The admin of a room can not be demoted, use /transfer to hand the room over"}
+	errModerated       error = &commandError{errCodeDenied, "The room is moderated, only mods and voiced users can talk in it"}
+	errKeyRequired     error = &commandError{errCodeDenied, "The room has a key, join it with /join <room_name> <key>"}
+	errWrongKey        error = &commandError{errCodeDenied, "Wrong key for the room"}
+	errInviteOnly      error = &commandError{errCodeDenied, "The room is invite only, ask a mod of the room for an invitation"}
+)
+
+// Rank of an identity in a room. A higher rank can act on lower ones
+type rank int
+
+const (
+	rankMember rank = iota
+	rankMod
+	rankAdmin
+)
+
+// Index of the connected clients and the rooms of a server, safe for use by every connection goroutine
+// The registry lock guards the maps and the fields of every room
+// The member lists of the rooms are the only record of which rooms a client is in
+// Client and room pointers stay the same for as long as they are registered
+// Clients are keyed by nameKey, so lookups ignore case and Unicode normalization
+type registry struct {
+	mu      sync.RWMutex
+	clients map[string]*client
+	rooms   map[string]*room
+	held    map[string]*heldSession // dropped connections waiting to be resumed, keyed like clients
+
+	// Rooms without members are removed after roomTTL, never when it is zero
+	// roomExpired is called with the name of every room removed that way
+	roomTTL     time.Duration
+	roomExpired func(roomName string)
+}
+
+// A dropped connection. Its name stays taken and its rooms and rights are kept until it is resumed or expires
+type heldSession struct {
+	token      string
+	name       string
+	account    string
+	guestID    string
+	rooms      []string
+	activeRoom string
+	timer      *time.Timer
+}
+
+// Creates an empty registry
+func newRegistry() *registry {
+	return &registry{
+		clients: make(map[string]*client),
+		rooms:   make(map[string]*room),
+		held:    make(map[string]*heldSession),
+	}
+}
+
+// Registers a client under its username
+// The name of a held session is taken, unless the client logged in to its account, which ends the held session
+func (r *registry) addClient(c *client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := nameKey(c.name())
+	if _, ok := r.clients[key]; ok {
+		return errNameTaken
+	}
+	if h, ok := r.held[key]; ok {
+		if c.accountName() == "" || nameKey(h.account) != key {
+			return errNameTaken
+		}
+		r.dropHeld(key)
+	}
+	r.clients[key] = c
+	return nil
+}
+
+// Removes a client from the connected clients and from its rooms, and returns the names of the rooms it left
+// The rights of a guest end with it, the rights of an account stay for its next login
+func (r *registry) removeClient(c *client) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A connection taken over by a resume is no longer registered, its name and rooms belong to the new one
+	key := nameKey(c.name())
+	if r.clients[key] != c {
+		return nil
+	}
+	delete(r.clients, key)
+
+	rooms := r.leaveRooms(c)
+	if c.accountName() == "" {
+		r.dropRights(c.identity())
+	}
+	return rooms
+}
+
+// Changes the username of a client, failing if another client already has the new name
+func (r *registry) renameClient(c *client, newName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	oldKey, newKey := nameKey(c.name()), nameKey(newName)
+	if other, ok := r.clients[newKey]; ok && other != c {
+		return errNameTaken
+	}
+	if _, ok := r.held[newKey]; ok {
+		return errNameTaken
+	}
+
+	delete(r.clients, oldKey)
+	r.clients[newKey] = c
+
+	c.mu.Lock()
+	c.username = newName
+	c.mu.Unlock()
+	return nil
+}
+
+// Returns a client, given a username
+func (r *registry) client(name string) *client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clients[nameKey(name)]
+}
+
+// Returns the name of the room. It changes when the room is renamed, so it is only read under the lock
+func (r *registry) roomName(rm *room) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return rm.roomName
+}
+
+// Returns every connected client sorted by username
+func (r *registry) clientList() []*client {
+	r.mu.RLock()
+	list := make([]*client, 0, len(r.clients))
+	for _, c := range r.clients {
+		list = append(list, c)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].name() < list[j].name() })
+	return list
+}
+
+// Returns the members of the room in the order they joined, nil if there is no such room
+func (r *registry) roomClients(roomName string) []*client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if rm, ok := r.rooms[roomName]; ok {
+		return rm.members
+	}
+	return nil
+}
+
+// Returns the names of the rooms the client is in, sorted
+func (r *registry) roomsOf(c *client) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.memberRooms(c)
+}
+
+// Returns the name of the room the client is focused on, or an empty string if it is in no room
+func (r *registry) activeRoom(c *client) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return c.activeRoom
+}
+
+// Checks whether the client is a member of the room
+func (r *registry) isMember(roomName string, c *client) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rm, ok := r.rooms[roomName]
+	return ok && containsClient(rm.members, c)
+}
+
+// Creates a new room with the client as its admin and first moderator
+// The room asks everyone but its staff and invited users for the key, unless the key is empty
+func (r *registry) createRoom(roomName string, admin *client, key string) (*room, error) {
+	newRoom := &room{
+		roomName:  roomName,
+		roomAdmin: admin.identity(),
+		mods:      []string{admin.identity()},
+	}
+	if key != "" {
+		var err error
+		if newRoom.keySalt, newRoom.keyHash, err = hashRoomKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.rooms[roomName]; ok {
+		return nil, errRoomExists
+	}
+	r.rooms[roomName] = newRoom
+	r.emptied(newRoom)
+	return newRoom, nil
+}
+
+// Returns a room, given a room name
+func (r *registry) room(roomName string) *room {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rooms[roomName]
+}
+
+// Returns the names of every room, sorted
+func (r *registry) roomNames() []string {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.rooms))
+	for name := range r.rooms {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// Adds the client to the members of the room and focuses the client on it. Rooms it is already in are kept
+// Clients that are not staff of the room need an invitation to an invite only room, or else the key of a room that has one
+// An invitation is used up by joining
+func (r *registry) joinRoom(c *client, roomName string, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rm, ok := r.rooms[roomName]
+	if !ok {
+		return errRoomNotFound
+	}
+	if containsClient(rm.members, c) {
+		return errAlreadyMember
+	}
+	if until, ok := rm.cooldowns[c.identity()]; ok {
+		if wait := time.Until(until); wait > 0 {
+			return errDenied("You were kicked from the room, you can join it again in " + wait.Round(time.Second).String())
+		}
+		delete(rm.cooldowns, c.identity())
+	}
+	if err := r.admit(rm, c.identity(), key); err != nil {
+		return err
+	}
+
+	rm.members = append(rm.members, c)
+	r.occupied(rm)
+	c.activeRoom = roomName
+	return nil
+}
+
+// Takes the client out of the members of the room, or of the room it is focused on when the name is empty
+// Returns the name of the room it left
+func (r *registry) quitRoom(c *client, roomName string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if roomName == "" {
+		if c.activeRoom == "" {
+			return "", errNotInRoom
+		}
+		roomName = c.activeRoom
+	}
+	if !r.leaveRoom(c, roomName) {
+		return "", errNotMember
+	}
+	return roomName, nil
+}
+
+// Focuses the client on one of the rooms it is in
+func (r *registry) focusRoom(c *client, roomName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rm, ok := r.rooms[roomName]
+	if !ok {
+		return errRoomNotFound
+	}
+	if !containsClient(rm.members, c) {
+		return errNotMember
+	}
+	c.activeRoom = roomName
+	return nil
+}
+
+// Takes the client out of the members of the room and keeps its identity from joining again for the cooldown
+// Returns false if it was not a member
+func (r *registry) kick(rm *room, c *client, cooldown time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.leaveRoom(c, rm.roomName) {
+		return false
+	}
+	if cooldown > 0 {
+		if rm.cooldowns == nil {
+			rm.cooldowns = make(map[string]time.Time)
+		}
+		rm.cooldowns[c.identity()] = time.Now().Add(cooldown)
+	}
+	return true
+}
+
+// Returns the names of the rooms the client is a member of, sorted. Called with the lock held
+func (r *registry) memberRooms(c *client) []string {
+	var names []string
+	for name, rm := range r.rooms {
+		if containsClient(rm.members, c) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Takes the client out of the members of the room, returns false if it was not a member. Called with the lock held
+// A client that leaves the room it is focused on is focused on another of its rooms
+func (r *registry) leaveRoom(c *client, roomName string) bool {
+	rm, ok := r.rooms[roomName]
+	if !ok || !containsClient(rm.members, c) {
+		return false
+	}
+	rm.members = removeClient(rm.members, c)
+	r.emptied(rm)
+
+	if c.activeRoom == roomName {
+		r.refocus(c)
+	}
+	return true
+}
+
+// Focuses the client on the first of its rooms, or on none. Called with the lock held
+func (r *registry) refocus(c *client) {
+	c.activeRoom = ""
+	if rooms := r.memberRooms(c); len(rooms) > 0 {
+		c.activeRoom = rooms[0]
+	}
+}
+
+// Takes the client out of every room and returns the names of the rooms it left. Called with the lock held
+func (r *registry) leaveRooms(c *client) []string {
+	rooms := r.memberRooms(c)
+	for _, name := range rooms {
+		rm := r.rooms[name]
+		rm.members = removeClient(rm.members, c)
+		r.emptied(rm)
+	}
+	c.activeRoom = ""
+	return rooms
+}
+
+// Removes the room and returns the clients that were in it. Clients focused on it are focused on another of their rooms
+func (r *registry) deleteRoom(roomName string) ([]*client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rm, ok := r.rooms[roomName]
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	delete(r.rooms, roomName)
+	r.occupied(rm)
+	r.forgetHeldRoom(roomName)
+
+	for _, c := range rm.members {
+		if c.activeRoom == roomName {
+			r.refocus(c)
+		}
+	}
+	return rm.members, nil
+}
+
+// Takes a removed room out of the held sessions, so a resumed client does not land in a new room with the same name
+// without its key, invitation or cooldown being checked. Called with the lock held
+func (r *registry) forgetHeldRoom(roomName string) {
+	for _, h := range r.held {
+		// The list is replaced rather than changed, the expiry of the session may be reading it
+		rooms := make([]string, 0, len(h.rooms))
+		for _, name := range h.rooms {
+			if name != roomName {
+				rooms = append(rooms, name)
+			}
+		}
+		h.rooms = rooms
+		if h.activeRoom == roomName {
+			h.activeRoom = ""
+		}
+	}
+}
+
+// Gives the room a new name, which clients and held sessions in it follow
+func (r *registry) renameRoom(oldName string, newName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rm, ok := r.rooms[oldName]
+	if !ok {
+		return errRoomNotFound
+	}
+	if _, ok := r.rooms[newName]; ok {
+		return errRoomExists
+	}
+
+	delete(r.rooms, oldName)
+	rm.roomName = newName
+	r.rooms[newName] = rm
+
+	for _, c := range rm.members {
+		if c.activeRoom == oldName {
+			c.activeRoom = newName
+		}
+	}
+	for _, h := range r.held {
+		// The list is replaced rather than changed, the expiry of the session may be reading it
+		rooms := make([]string, len(h.rooms))
+		for i, name := range h.rooms {
+			if name == oldName {
+				name = newName
+			}
+			rooms[i] = name
+		}
+		h.rooms = rooms
+		if h.activeRoom == oldName {
+			h.activeRoom = newName
+		}
+	}
+	return nil
+}
+
+// Makes the client the admin of the room, and a moderator if it is not one yet
+func (r *registry) transfer(rm *room, c *client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.makeAdmin(rm, c)
+}
+
+// Hands the room over after the identity left it, if the identity was its admin or the room has none
+// The longest-standing moderator in the room becomes the admin, or the longest-standing member if no moderator is in it
+// Returns the new admin, or nil if the room kept its admin
+func (r *registry) handOver(roomName string, leaving string) *client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rm, ok := r.rooms[roomName]
+	if !ok || (rm.roomAdmin != leaving && rm.roomAdmin != "") {
+		return nil
+	}
+	// The admin may have come back in the meantime
+	if rm.roomAdmin != "" && memberWithIdentity(rm, rm.roomAdmin) != nil {
+		return nil
+	}
+
+	// Moderators are listed in the order they were promoted
+	var next *client
+	for _, id := range rm.mods {
+		if id == leaving {
+			continue
+		}
+		if next = memberWithIdentity(rm, id); next != nil {
+			break
+		}
+	}
+	if next == nil {
+		for _, c := range rm.members {
+			if c.identity() != leaving {
+				next = c
+				break
+			}
+		}
+	}
+	if next == nil {
+		return nil
+	}
+
+	r.makeAdmin(rm, next)
+	return next
+}
+
+// Makes the client the admin and a moderator of the room. Called with the lock held
+func (r *registry) makeAdmin(rm *room, c *client) {
+	rm.roomAdmin = c.identity()
+	if !containsString(rm.mods, rm.roomAdmin) {
+		rm.mods = append(rm.mods, rm.roomAdmin)
+	}
+}
+
+// Starts the expiry of the room if nobody is in it. Called with the lock held
+func (r *registry) emptied(rm *room) {
+	if len(rm.members) > 0 || rm.expiry != nil || r.roomTTL <= 0 {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(r.roomTTL, func() {
+		r.mu.Lock()
+		// A client may have joined, or the room may have been deleted, while the timer fired
+		expired := rm.expiry == timer && len(rm.members) == 0 && r.rooms[rm.roomName] == rm
+		if rm.expiry == timer {
+			rm.expiry = nil
+		}
+		if expired {
+			delete(r.rooms, rm.roomName)
+			r.forgetHeldRoom(rm.roomName)
+		}
+		roomName := rm.roomName
+		r.mu.Unlock()
+
+		if expired && r.roomExpired != nil {
+			r.roomExpired(roomName)
+		}
+	})
+	rm.expiry = timer
+}
+
+// Stops the expiry of the room. Called with the lock held
+func (r *registry) occupied(rm *room) {
+	if rm.expiry != nil {
+		rm.expiry.Stop()
+		rm.expiry = nil
+	}
+}
+
+// Returns the member of the room with the identity, or nil. Called with the lock held
+func memberWithIdentity(rm *room, identity string) *client {
+	for _, c := range rm.members {
+		if c.identity() == identity {
+			return c
+		}
+	}
+	return nil
+}
+
+// Takes the identity out of the admin and moderators of every room. Called with the lock held
+func (r *registry) dropRights(identity string) {
+	for _, rm := range r.rooms {
+		if rm.roomAdmin == identity {
+			rm.roomAdmin = ""
+		}
+		if containsString(rm.mods, identity) {
+			var mods []string
+			for _, id := range rm.mods {
+				if id != identity {
+					mods = append(mods, id)
+				}
+			}
+			rm.mods = mods
+		}
+	}
+}
+
+// Makes the client a moderator of the room
+func (r *registry) promote(rm *room, c *client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !containsString(rm.mods, c.identity()) {
+		rm.mods = append(rm.mods, c.identity())
+	}
+}
+
+// Takes the identity out of the moderators of the room. The admin has to hand the room over first
+func (r *registry) demote(rm *room, identity string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rm.roomAdmin == identity {
+		return errDemoteAdmin
+	}
+	if !containsString(rm.mods, identity) {
+		return errNotMod
+	}
+
+	var mods []string
+	for _, id := range rm.mods {
+		if id != identity {
+			mods = append(mods, id)
+		}
+	}
+	rm.mods = mods
+	return nil
+}
+
+// Keeps the identity from talking in the room until the time, or until it is unmuted when the time is zero
+func (r *registry) mute(rm *room, identity string, until time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rm.muted == nil {
+		rm.muted = make(map[string]time.Time)
+	}
+	rm.muted[identity] = until
+}
+
+// Lets the identity talk in the room again, returns false if it was not muted
+func (r *registry) unmute(rm *room, identity string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	until, ok := rm.muted[identity]
+	delete(rm.muted, identity)
+	return ok && (until.IsZero() || time.Now().Before(until))
+}
+
+// Turns the moderated mode of the room on or off
+func (r *registry) setModerated(rm *room, on bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rm.moderated = on
+}
+
+// Checks whether only mods and voiced users can talk in the room
+func (r *registry) isModerated(rm *room) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return rm.moderated
+}
+
+// Lets the identity talk while the room is moderated, returns false if it already could
+func (r *registry) voice(rm *room, identity string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if containsString(rm.voiced, identity) {
+		return false
+	}
+	rm.voiced = append(rm.voiced, identity)
+	return true
+}
+
+// Takes the voice of the identity away, returns false if it had none
+func (r *registry) devoice(rm *room, identity string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !containsString(rm.voiced, identity) {
+		return false
+	}
+	var voiced []string
+	for _, id := range rm.voiced {
+		if id != identity {
+			voiced = append(voiced, id)
+		}
+	}
+	rm.voiced = voiced
+	return true
+}
+
+// Checks whether the identity may join the room with the key, using up its invitation. Called with the lock held
+func (r *registry) admit(rm *room, identity string, key string) error {
+	if rm.roomAdmin == identity || containsString(rm.mods, identity) {
+		return nil
+	}
+
+	if until, ok := rm.invites[identity]; ok {
+		delete(rm.invites, identity)
+		if time.Now().Before(until) {
+			return nil
+		}
+	}
+	if rm.inviteOnly {
+		return errInviteOnly
+	}
+
+	if rm.keyHash == nil {
+		return nil
+	}
+	if key == "" {
+		return errKeyRequired
+	}
+	if subtle.ConstantTimeCompare(roomKeyDigest(rm.keySalt, key), rm.keyHash) != 1 {
+		return errWrongKey
+	}
+	return nil
+}
+
+// Lets the identity join the room until the time, without the key and while the room is invite only
+func (r *registry) invite(rm *room, identity string, until time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rm.invites == nil {
+		rm.invites = make(map[string]time.Time)
+	}
+	for id, expires := range rm.invites {
+		if !time.Now().Before(expires) {
+			delete(rm.invites, id)
+		}
+	}
+	rm.invites[identity] = until
+}
+
+// Turns the invite only mode of the room on or off
+func (r *registry) setInviteOnly(rm *room, on bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rm.inviteOnly = on
+}
+
+// Checks whether only invited users can join the room
+func (r *registry) isInviteOnly(rm *room) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return rm.inviteOnly
+}
+
+// Checks whether the client can talk in the room, and returns the reason if it can not
+// A muted client can not talk, in a moderated room only mods and voiced clients can
+func (r *registry) checkSpeak(rm *room, c *client) error {
+	if rm == nil {
+		return errRoomNotFound
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	identity := c.identity()
+	if until, ok := rm.muted[identity]; ok {
+		if until.IsZero() {
+			return errDenied("You are muted in the room")
+		}
+		if wait := time.Until(until); wait > 0 {
+			return errDenied("You are muted in the room for " + wait.Round(time.Second).String())
+		}
+		delete(rm.muted, identity)
+	}
+
+	if rm.moderated && rm.roomAdmin != identity && !containsString(rm.mods, identity) && !containsString(rm.voiced, identity) {
+		return errModerated
+	}
+	return nil
+}
+
+// Returns the rank of the client in the room, rankMember when there is no room
+func (r *registry) rank(rm *room, c *client) rank {
+	return r.identityRank(rm, c.identity())
+}
+
+// Returns the rank of the identity in the room, rankMember when there is no room
+func (r *registry) identityRank(rm *room, identity string) rank {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	switch {
+	case rm == nil || identity == "":
+		return rankMember
+	case rm.roomAdmin == identity:
+		return rankAdmin
+	case containsString(rm.mods, identity):
+		return rankMod
+	}
+	return rankMember
+}
+
+// Checks whether the client is the admin of the room
+func (r *registry) isAdmin(rm *room, c *client) bool {
+	return rm != nil && r.rank(rm, c) == rankAdmin
+}
+
+// Checks whether the client is a moderator of the room, the admin is one too
+func (r *registry) isMod(rm *room, c *client) bool {
+	return rm != nil && r.rank(rm, c) >= rankMod
+}
+
+// Returns the identity of the admin and of the moderators of the room, in the order they were promoted
+func (r *registry) staff(rm *room) (string, []string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return rm.roomAdmin, append([]string(nil), rm.mods...)
+}
+
+// Returns the name of the connected or held client with the identity, or an empty string
+func (r *registry) identityName(identity string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, c := range r.clients {
+		if c.identity() == identity {
+			return c.name()
+		}
+	}
+	for _, h := range r.held {
+		if h.guestID == identity || (h.account != "" && accountIdentity(h.account) == identity) {
+			return h.name
+		}
+	}
+	return ""
+}
+
+// Logs the client in to the account. The client takes the account name as its username,
+// and if it was a guest the rights it held move to the account
+func (r *registry) login(c *client, accountName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	oldKey, newKey := nameKey(c.name()), nameKey(accountName)
+	if other, ok := r.clients[newKey]; ok && other != c {
+		return errAccountLoggedIn
+	}
+
+	// Logging in with the password ends a held session of the account, or of a guest with the name
+	r.dropHeld(newKey)
+
+	wasGuest, oldIdentity := c.accountName() == "", c.identity()
+	delete(r.clients, oldKey)
+	r.clients[newKey] = c
+
+	c.mu.Lock()
+	c.username = accountName
+	c.account = accountName
+	c.mu.Unlock()
+
+	if !wasGuest {
+		return nil
+	}
+
+	newIdentity := c.identity()
+	for _, rm := range r.rooms {
+		if rm.roomAdmin == oldIdentity {
+			rm.roomAdmin = newIdentity
+		}
+
+		var mods []string
+		for _, id := range rm.mods {
+			if id == oldIdentity {
+				id = newIdentity
+			}
+			if !containsString(mods, id) {
+				mods = append(mods, id)
+			}
+		}
+		rm.mods = mods
+	}
+	return nil
+}
+
+// Takes a client whose connection dropped out of the clients and holds its name, rooms and rights for the grace period
+// Returns false if the client is not registered
+// expired is called with the name, the identity and the rooms if the session is not resumed in time
+func (r *registry) hold(c *client, grace time.Duration, expired func(name string, identity string, rooms []string)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := nameKey(c.name())
+	if r.clients[key] != c {
+		return false
+	}
+	delete(r.clients, key)
+	activeRoom := c.activeRoom
+	rooms := r.leaveRooms(c)
+
+	c.mu.Lock()
+	h := &heldSession{token: c.token, name: c.username, account: c.account, guestID: c.guestID, rooms: rooms, activeRoom: activeRoom}
+	c.mu.Unlock()
+
+	r.held[key] = h
+	h.timer = time.AfterFunc(grace, func() {
+		r.mu.Lock()
+		current, rooms := r.held[key] == h, h.rooms
+		if current {
+			delete(r.held, key)
+			if h.account == "" {
+				r.dropRights(h.guestID)
+			}
+		}
+		r.mu.Unlock()
+
+		if current {
+			identity := h.guestID
+			if h.account != "" {
+				identity = accountIdentity(h.account)
+			}
+			expired(h.name, identity, rooms)
+		}
+	})
+	return true
+}
+
+// Gives the held session with the name of the client and the token back to the client, with newToken for the next resume
+// A connection the server has not noticed to be dropped yet is taken over and returned, for the caller to close
+// Returns false if there is no such session or the token does not match
+func (r *registry) resume(c *client, token string, newToken string) (bool, *client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := nameKey(c.name())
+	var replaced *client
+	h, ok := r.held[key]
+	if old, live := r.clients[key]; live {
+		old.mu.Lock()
+		h = &heldSession{token: old.token, name: old.username, account: old.account, guestID: old.guestID}
+		old.mu.Unlock()
+		h.rooms, h.activeRoom = r.memberRooms(old), old.activeRoom
+		ok, replaced = true, old
+	}
+	if !ok || subtle.ConstantTimeCompare([]byte(h.token), []byte(token)) != 1 {
+		return false, nil
+	}
+
+	if replaced != nil {
+		delete(r.clients, key)
+		r.leaveRooms(replaced)
+	}
+	r.dropHeld(key)
+
+	c.mu.Lock()
+	c.username = h.name
+	c.account = h.account
+	c.guestID = h.guestID
+	c.token = newToken
+	c.mu.Unlock()
+
+	// Rooms may have been removed while the connection was down
+	r.clients[key] = c
+	for _, name := range h.rooms {
+		if rm, ok := r.rooms[name]; ok {
+			rm.members = append(rm.members, c)
+			r.occupied(rm)
+			if c.activeRoom == "" || name == h.activeRoom {
+				c.activeRoom = name
+			}
+		}
+	}
+	return true, replaced
+}
+
+// Ends the held session with the key, if any. Called with the lock held
+func (r *registry) dropHeld(key string) {
+	if h, ok := r.held[key]; ok {
+		h.timer.Stop()
+		delete(r.held, key)
+	}
+}
+
+// Checks whether the client list contains the client
+func containsClient(list []*client, c *client) bool {
+	for _, v := range list {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the client list without the client. The list is copied so snapshots taken earlier stay unchanged
+func removeClient(list []*client, c *client) []*client {
+	kept := make([]*client, 0, len(list))
+	for _, v := range list {
+		if v != c {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// Checks whether the list contains the string
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
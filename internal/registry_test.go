@@ -0,0 +1,616 @@
+package internal
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistryAddClientRejectsTakenName(t *testing.T) {
+	reg := newRegistry()
+
+	first := &client{username: "alice"}
+	if err := reg.addClient(first); err != nil {
+		t.Fatalf("addClient: %v", err)
+	}
+	if err := reg.addClient(&client{username: "alice"}); err != errNameTaken {
+		t.Fatalf("addClient with a taken name = %v, want %v", err, errNameTaken)
+	}
+	if got := reg.client("alice"); got != first {
+		t.Fatalf("client(alice) = %p, want %p", got, first)
+	}
+}
+
+func TestRegistryNamesIgnoreCaseAndNormalization(t *testing.T) {
+	reg := newRegistry()
+
+	alice := &client{username: "Alice"}
+	if err := reg.addClient(alice); err != nil {
+		t.Fatalf("addClient: %v", err)
+	}
+	for _, name := range []string{"alice", "ALICE", "Ａｌｉｃｅ"} {
+		if err := reg.addClient(&client{username: name}); err != errNameTaken {
+			t.Errorf("addClient(%q) = %v, want %v", name, err, errNameTaken)
+		}
+		if got := reg.client(name); got != alice {
+			t.Errorf("client(%q) = %p, want %p", name, got, alice)
+		}
+	}
+
+	// Composed and decomposed spellings of the same name are one user
+	if err := reg.addClient(&client{username: cleanName("Jose\u0301")}); err != nil {
+		t.Fatalf("addClient: %v", err)
+	}
+	if err := reg.addClient(&client{username: cleanName("jos\u00e9")}); err != errNameTaken {
+		t.Fatalf("addClient with a differently normalized name = %v, want %v", err, errNameTaken)
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	reserved := []string{"SERVER"}
+	for _, name := range []string{"", "two words", "server", "Server", "a\tb", "x123456789012345678901234567890123"} {
+		if validateName(name, reserved) == nil {
+			t.Errorf("validateName(%q) accepted an invalid name", name)
+		}
+	}
+	for _, name := range []string{"alice", "bob_2", "zoë", "a.b-c"} {
+		if err := validateName(name, reserved); err != nil {
+			t.Errorf("validateName(%q) = %v", name, err)
+		}
+	}
+}
+
+func TestRegistryRenameClient(t *testing.T) {
+	reg := newRegistry()
+	alice := &client{username: "alice"}
+	bob := &client{username: "bob"}
+	reg.addClient(alice)
+	reg.addClient(bob)
+
+	if err := reg.renameClient(alice, "bob"); err != errNameTaken {
+		t.Fatalf("renameClient to a taken name = %v, want %v", err, errNameTaken)
+	}
+	if err := reg.renameClient(alice, "carol"); err != nil {
+		t.Fatalf("renameClient: %v", err)
+	}
+	if reg.client("alice") != nil {
+		t.Fatal("old name is still registered")
+	}
+	if reg.client("carol") != alice || alice.name() != "carol" {
+		t.Fatal("client is not registered under the new name")
+	}
+}
+
+func TestRegistryRoomRights(t *testing.T) {
+	reg := newRegistry()
+	admin := &client{username: "admin", guestID: "guest:1"}
+	member := &client{username: "member", guestID: "guest:2"}
+	reg.addClient(admin)
+	reg.addClient(member)
+
+	rm, err := reg.createRoom("lobby", admin, "")
+	if err != nil {
+		t.Fatalf("createRoom: %v", err)
+	}
+	if _, err := reg.createRoom("lobby", member, ""); err != errRoomExists {
+		t.Fatalf("createRoom with a taken name = %v, want %v", err, errRoomExists)
+	}
+
+	if err := reg.joinRoom(member, "lobby", ""); err != nil {
+		t.Fatalf("joinRoom: %v", err)
+	}
+	reg.promote(rm, member)
+
+	// The registered room is the one handed out, so later changes are visible through it
+	if reg.room("lobby") != rm {
+		t.Fatal("room lookup returned a different room")
+	}
+	if !reg.isMod(rm, member) {
+		t.Fatal("promotion is not visible")
+	}
+	if !reg.isAdmin(rm, admin) || reg.isAdmin(rm, member) {
+		t.Fatal("isAdmin does not match the room admin")
+	}
+	if got := reg.roomClients("lobby"); len(got) != 1 || got[0] != member {
+		t.Fatalf("roomClients(lobby) = %v, want only member", got)
+	}
+}
+
+func TestRegistryLoginMovesGuestRights(t *testing.T) {
+	reg := newRegistry()
+	guest := &client{username: "guest", guestID: "guest:1"}
+	reg.addClient(guest)
+	rm, _ := reg.createRoom("lobby", guest, "")
+
+	if err := reg.login(guest, "Alice"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if reg.client("alice") != guest || guest.name() != "Alice" {
+		t.Fatal("client is not registered under the account name")
+	}
+	if !reg.isAdmin(rm, guest) || !reg.isMod(rm, guest) {
+		t.Fatal("rights did not move to the account")
+	}
+
+	// A later connection logged in to the same account holds the same rights
+	again := &client{username: "other", guestID: "guest:2"}
+	reg.removeClient(guest)
+	reg.addClient(again)
+	if err := reg.login(again, "Alice"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if !reg.isAdmin(rm, again) {
+		t.Fatal("rights did not follow the account to the new connection")
+	}
+
+	intruder := &client{username: "intruder", guestID: "guest:3"}
+	reg.addClient(intruder)
+	if err := reg.login(intruder, "alice"); err != errAccountLoggedIn {
+		t.Fatalf("login to an account in use = %v, want %v", err, errAccountLoggedIn)
+	}
+}
+
+// Run with -race. Many connections register, rename, join and leave at the same time
+func TestRegistryConcurrentAccess(t *testing.T) {
+	reg := newRegistry()
+	admin := &client{username: "admin", guestID: "guest:admin"}
+	reg.addClient(admin)
+	rm, _ := reg.createRoom("lobby", admin, "")
+
+	const workers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			cli := &client{username: "user" + strconv.Itoa(i), guestID: "guest:" + strconv.Itoa(i)}
+			if err := reg.addClient(cli); err != nil {
+				t.Errorf("addClient: %v", err)
+				return
+			}
+
+			reg.joinRoom(cli, "lobby", "")
+			reg.promote(rm, cli)
+			reg.isMod(rm, cli)
+			reg.clientList()
+			reg.roomClients("lobby")
+			reg.roomNames()
+
+			if err := reg.renameClient(cli, "renamed"+strconv.Itoa(i)); err != nil {
+				t.Errorf("renameClient: %v", err)
+			}
+			reg.quitRoom(cli, "lobby")
+
+			if i%2 == 0 {
+				reg.removeClient(cli)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got, want := len(reg.clientList()), 1+workers/2; got != want {
+		t.Fatalf("%d clients registered, want %d", got, want)
+	}
+	for _, c := range reg.clientList() {
+		if reg.client(c.name()) != c {
+			t.Fatalf("client %q is not registered under its own name", c.name())
+		}
+	}
+}
+
+func TestRegistryHoldAndResume(t *testing.T) {
+	reg := newRegistry()
+	alice := &client{username: "alice", guestID: "guest:1", token: "secret"}
+	reg.addClient(alice)
+	rm, _ := reg.createRoom("lobby", alice, "")
+	reg.joinRoom(alice, "lobby", "")
+
+	expired := make(chan string, 1)
+	if !reg.hold(alice, time.Hour, func(name string, identity string, rooms []string) { expired <- name }) {
+		t.Fatal("hold refused a registered client")
+	}
+	if reg.client("alice") != nil || len(reg.roomClients("lobby")) != 0 {
+		t.Fatal("held client is still connected")
+	}
+
+	// The name stays taken while the session is held
+	if err := reg.addClient(&client{username: "alice", guestID: "guest:2"}); err != errNameTaken {
+		t.Fatalf("addClient with a held name = %v, want %v", err, errNameTaken)
+	}
+
+	if ok, _ := reg.resume(&client{username: "alice", guestID: "guest:3"}, "wrong", "next"); ok {
+		t.Fatal("resume accepted a wrong token")
+	}
+
+	again := &client{username: "alice", guestID: "guest:4"}
+	if ok, replaced := reg.resume(again, "secret", "next"); !ok || replaced != nil {
+		t.Fatalf("resume = %v, %v, want true, nil", ok, replaced)
+	}
+	if reg.client("alice") != again || reg.activeRoom(again) != "lobby" || !reg.isAdmin(rm, again) {
+		t.Fatal("resumed client did not get the name, room and rights back")
+	}
+	if ok, _ := reg.resume(&client{username: "alice", guestID: "guest:5"}, "secret", "other"); ok {
+		t.Fatal("a used token resumed the session again")
+	}
+
+	// A session that is not resumed in time frees the name
+	bob := &client{username: "bob", guestID: "guest:6"}
+	reg.addClient(bob)
+	reg.joinRoom(bob, "lobby", "")
+	reg.promote(rm, bob)
+	reg.hold(bob, time.Millisecond, func(name string, identity string, rooms []string) { expired <- name + "@" + strings.Join(rooms, ",") })
+	if got := <-expired; got != "bob@lobby" {
+		t.Fatalf("expired %q, want bob@lobby", got)
+	}
+	if containsString(rm.mods, "guest:6") {
+		t.Fatal("the rights of an expired guest were kept")
+	}
+	if err := reg.addClient(&client{username: "bob", guestID: "guest:7"}); err != nil {
+		t.Fatalf("addClient after the session expired: %v", err)
+	}
+}
+
+func TestRegistryMembership(t *testing.T) {
+	reg := newRegistry()
+	guest := &client{username: "guest", guestID: "guest:1"}
+	member := &client{username: "member", guestID: "guest:2"}
+	reg.addClient(guest)
+	reg.addClient(member)
+
+	if err := reg.joinRoom(member, "nowhere", ""); err != errRoomNotFound {
+		t.Fatalf("joinRoom to a missing room = %v, want %v", err, errRoomNotFound)
+	}
+	if reg.activeRoom(member) != "" || len(reg.roomsOf(member)) != 0 {
+		t.Fatal("a failed join put the client in a room")
+	}
+
+	lobby, _ := reg.createRoom("lobby", guest, "")
+	reg.createRoom("games", member, "")
+	reg.joinRoom(guest, "lobby", "")
+	reg.joinRoom(member, "lobby", "")
+	if err := reg.joinRoom(member, "lobby", ""); err != errAlreadyMember {
+		t.Fatalf("joinRoom twice = %v, want %v", err, errAlreadyMember)
+	}
+	if got := reg.roomClients("lobby"); len(got) != 2 || got[0] != guest || got[1] != member {
+		t.Fatalf("roomClients(lobby) = %v, want guest and member in the order they joined", got)
+	}
+
+	// Joining another room keeps the first one and focuses the new one
+	if err := reg.joinRoom(member, "games", ""); err != nil {
+		t.Fatalf("joinRoom: %v", err)
+	}
+	if got := reg.roomsOf(member); len(got) != 2 || got[0] != "games" || got[1] != "lobby" {
+		t.Fatalf("roomsOf(member) = %v, want games and lobby", got)
+	}
+	if reg.activeRoom(member) != "games" {
+		t.Fatalf("activeRoom(member) = %q, want games", reg.activeRoom(member))
+	}
+
+	if err := reg.focusRoom(member, "lobby"); err != nil || reg.activeRoom(member) != "lobby" {
+		t.Fatalf("focusRoom = %v, active room %q, want lobby", err, reg.activeRoom(member))
+	}
+	if err := reg.focusRoom(guest, "games"); err != errNotMember {
+		t.Fatalf("focusRoom on a room the client is not in = %v, want %v", err, errNotMember)
+	}
+
+	// Quitting the focused room focuses one of the others
+	if roomName, err := reg.quitRoom(member, ""); err != nil || roomName != "lobby" {
+		t.Fatalf("quitRoom = %q, %v, want lobby, nil", roomName, err)
+	}
+	if reg.activeRoom(member) != "games" {
+		t.Fatalf("activeRoom after quitting = %q, want games", reg.activeRoom(member))
+	}
+	if _, err := reg.quitRoom(member, "lobby"); err != errNotMember {
+		t.Fatalf("quitRoom on a room the client left = %v, want %v", err, errNotMember)
+	}
+	reg.quitRoom(member, "games")
+	if _, err := reg.quitRoom(member, ""); err != errNotInRoom {
+		t.Fatalf("quitRoom outside a room = %v, want %v", err, errNotInRoom)
+	}
+
+	// A guest that disconnects leaves its rooms and its rights
+	reg.joinRoom(guest, "games", "")
+	if rooms := reg.removeClient(guest); len(rooms) != 2 {
+		t.Fatalf("removeClient = %v, want games and lobby", rooms)
+	}
+	if len(reg.roomClients("lobby")) != 0 || lobby.roomAdmin != "" || len(lobby.mods) != 0 {
+		t.Fatal("a removed guest is still a member or holds rights")
+	}
+
+	// The rights of an account stay for its next login
+	alice := &client{username: "alice", guestID: "guest:3"}
+	reg.addClient(alice)
+	reg.login(alice, "alice")
+	reg.promote(lobby, alice)
+	reg.removeClient(alice)
+	if !containsString(lobby.mods, accountIdentity("alice")) {
+		t.Fatal("the rights of an account were dropped on disconnect")
+	}
+}
+
+func TestRegistryHandOver(t *testing.T) {
+	reg := newRegistry()
+	admin := &client{username: "admin", guestID: "guest:1"}
+	first := &client{username: "first", guestID: "guest:2"}
+	second := &client{username: "second", guestID: "guest:3"}
+	member := &client{username: "member", guestID: "guest:4"}
+	for _, c := range []*client{admin, first, second, member} {
+		reg.addClient(c)
+	}
+	rm, _ := reg.createRoom("lobby", admin, "")
+	for _, c := range []*client{admin, member, second, first} {
+		reg.joinRoom(c, "lobby", "")
+	}
+	reg.promote(rm, first)
+	reg.promote(rm, second)
+
+	// Leaving does not hand over a room whose admin is still there
+	if next := reg.handOver("lobby", member.identity()); next != nil {
+		t.Fatalf("handOver after a member left = %v, want nil", next.name())
+	}
+
+	// The mod promoted first takes over, even though it joined last
+	reg.removeClient(admin)
+	if next := reg.handOver("lobby", admin.identity()); next != first || !reg.isAdmin(rm, first) {
+		t.Fatalf("handOver gave the room to %v, want first", next)
+	}
+
+	// Without a mod in the room the longest-standing member takes over
+	reg.quitRoom(second, "lobby")
+	reg.quitRoom(first, "lobby")
+	if next := reg.handOver("lobby", first.identity()); next != member || !reg.isAdmin(rm, member) || !reg.isMod(rm, member) {
+		t.Fatalf("handOver gave the room to %v, want member", next)
+	}
+}
+
+func TestRegistryDeleteAndRenameRoom(t *testing.T) {
+	reg := newRegistry()
+	alice := &client{username: "alice", guestID: "guest:1", token: "secret"}
+	bob := &client{username: "bob", guestID: "guest:2"}
+	reg.addClient(alice)
+	reg.addClient(bob)
+	reg.createRoom("lobby", alice, "")
+	reg.createRoom("games", alice, "")
+	reg.joinRoom(alice, "lobby", "")
+	reg.joinRoom(bob, "games", "")
+	reg.joinRoom(bob, "lobby", "")
+
+	if err := reg.renameRoom("lobby", "games"); err != errRoomExists {
+		t.Fatalf("renameRoom to a taken name = %v, want %v", err, errRoomExists)
+	}
+	reg.hold(alice, time.Hour, func(string, string, []string) {})
+	if err := reg.renameRoom("lobby", "hall"); err != nil {
+		t.Fatalf("renameRoom: %v", err)
+	}
+	if reg.room("lobby") != nil || reg.room("hall") == nil || reg.activeRoom(bob) != "hall" {
+		t.Fatal("the room or the clients in it did not follow the new name")
+	}
+
+	// A held session comes back to the room under its new name
+	again := &client{username: "alice", guestID: "guest:3"}
+	if ok, _ := reg.resume(again, "secret", "next"); !ok || reg.activeRoom(again) != "hall" {
+		t.Fatalf("resumed client is in %q, want hall", reg.activeRoom(again))
+	}
+
+	members, err := reg.deleteRoom("hall")
+	if err != nil || len(members) != 2 {
+		t.Fatalf("deleteRoom = %v, %v, want both members", members, err)
+	}
+	if reg.room("hall") != nil || reg.activeRoom(bob) != "games" || reg.activeRoom(again) != "" {
+		t.Fatal("clients are still focused on the deleted room")
+	}
+	if _, err := reg.deleteRoom("hall"); err != errRoomNotFound {
+		t.Fatalf("deleteRoom twice = %v, want %v", err, errRoomNotFound)
+	}
+
+	// A held session does not come back to a new room that took the name of a deleted one
+	bob.token = "bobs"
+	reg.hold(bob, time.Hour, func(string, string, []string) {})
+	if _, err := reg.deleteRoom("games"); err != nil {
+		t.Fatalf("deleteRoom: %v", err)
+	}
+	reg.createRoom("games", again, "s3cret")
+	bobAgain := &client{username: "bob", guestID: "guest:4"}
+	if ok, _ := reg.resume(bobAgain, "bobs", "next"); !ok {
+		t.Fatal("resume failed")
+	}
+	if reg.isMember("games", bobAgain) || reg.activeRoom(bobAgain) != "" {
+		t.Fatal("the resumed client got into a new room with the name of a deleted one")
+	}
+}
+
+func TestRegistryEmptyRoomExpires(t *testing.T) {
+	reg := newRegistry()
+	reg.roomTTL = 20 * time.Millisecond
+	expired := make(chan string, 1)
+	reg.roomExpired = func(roomName string) { expired <- roomName }
+
+	alice := &client{username: "alice", guestID: "guest:1"}
+	reg.addClient(alice)
+	reg.createRoom("lobby", alice, "")
+	reg.joinRoom(alice, "lobby", "")
+
+	// A room with members is kept
+	time.Sleep(4 * reg.roomTTL)
+	if reg.room("lobby") == nil {
+		t.Fatal("a room with members expired")
+	}
+
+	reg.quitRoom(alice, "lobby")
+	if name := <-expired; name != "lobby" || reg.room("lobby") != nil {
+		t.Fatalf("expired %q, want lobby to be removed", name)
+	}
+}
+
+func TestRegistryRanksAndDemote(t *testing.T) {
+	reg := newRegistry()
+	admin := &client{username: "admin", guestID: "guest:1"}
+	mod := &client{username: "mod", guestID: "guest:2"}
+	member := &client{username: "member", guestID: "guest:3"}
+	for _, c := range []*client{admin, mod, member} {
+		reg.addClient(c)
+	}
+	rm, _ := reg.createRoom("lobby", admin, "")
+	reg.promote(rm, mod)
+
+	if reg.rank(rm, admin) != rankAdmin || reg.rank(rm, mod) != rankMod || reg.rank(rm, member) != rankMember {
+		t.Fatal("ranks do not match the admin and mods of the room")
+	}
+	if reg.rank(nil, admin) != rankMember {
+		t.Fatal("a client outside any room has a rank above member")
+	}
+
+	// A guest ban kept over a restart has no identity, which must not match a room that lost its admin
+	rm.roomAdmin = ""
+	if reg.identityRank(rm, "") != rankMember {
+		t.Fatal("an empty identity has a rank above member")
+	}
+	rm.roomAdmin = admin.identity()
+
+	if err := reg.demote(rm, admin.identity()); err != errDemoteAdmin {
+		t.Fatalf("demote the admin = %v, want %v", err, errDemoteAdmin)
+	}
+	if err := reg.demote(rm, member.identity()); err != errNotMod {
+		t.Fatalf("demote a member = %v, want %v", err, errNotMod)
+	}
+	if err := reg.demote(rm, mod.identity()); err != nil {
+		t.Fatalf("demote: %v", err)
+	}
+	if reg.isMod(rm, mod) {
+		t.Fatal("demoted client is still a mod")
+	}
+
+	adminID, mods := reg.staff(rm)
+	if adminID != admin.identity() || len(mods) != 1 || mods[0] != admin.identity() {
+		t.Fatalf("staff = %q, %v, want only the admin", adminID, mods)
+	}
+	if reg.identityName(mod.identity()) != "mod" || reg.identityName("guest:9") != "" {
+		t.Fatal("identityName does not find the connected clients only")
+	}
+}
+
+func TestRegistryKickCooldown(t *testing.T) {
+	reg := newRegistry()
+	admin := &client{username: "admin", guestID: "guest:1"}
+	bob := &client{username: "bob", guestID: "guest:2"}
+	reg.addClient(admin)
+	reg.addClient(bob)
+	rm, _ := reg.createRoom("lobby", admin, "")
+	reg.joinRoom(bob, "lobby", "")
+
+	if !reg.kick(rm, bob, time.Hour) {
+		t.Fatal("kick refused a member")
+	}
+	if reg.isMember("lobby", bob) || reg.activeRoom(bob) != "" {
+		t.Fatal("kicked client is still in the room")
+	}
+	if reg.kick(rm, bob, time.Hour) {
+		t.Fatal("kick accepted a client that is not in the room")
+	}
+
+	var cmdErr *commandError
+	if err := reg.joinRoom(bob, "lobby", ""); !errors.As(err, &cmdErr) || cmdErr.code != errCodeDenied {
+		t.Fatalf("joinRoom during the cooldown = %v, want a denied error", err)
+	}
+
+	// Once the cooldown is over the client can join again
+	rm.cooldowns[bob.identity()] = time.Now().Add(-time.Second)
+	if err := reg.joinRoom(bob, "lobby", ""); err != nil {
+		t.Fatalf("joinRoom after the cooldown: %v", err)
+	}
+}
+
+func TestRegistryMuteAndModerated(t *testing.T) {
+	reg := newRegistry()
+	admin := &client{username: "admin", guestID: "guest:1"}
+	bob := &client{username: "bob", guestID: "guest:2"}
+	reg.addClient(admin)
+	reg.addClient(bob)
+	rm, _ := reg.createRoom("lobby", admin, "")
+
+	if err := reg.checkSpeak(rm, bob); err != nil {
+		t.Fatalf("checkSpeak for a member: %v", err)
+	}
+
+	reg.mute(rm, bob.identity(), time.Time{})
+	if err := reg.checkSpeak(rm, bob); err == nil {
+		t.Fatal("a muted client can talk")
+	}
+	if !reg.unmute(rm, bob.identity()) || reg.checkSpeak(rm, bob) != nil {
+		t.Fatal("an unmuted client can not talk")
+	}
+
+	// A timed mute ends on its own
+	reg.mute(rm, bob.identity(), time.Now().Add(-time.Second))
+	if err := reg.checkSpeak(rm, bob); err != nil {
+		t.Fatalf("checkSpeak after the mute ran out: %v", err)
+	}
+
+	reg.setModerated(rm, true)
+	if err := reg.checkSpeak(rm, bob); err != errModerated {
+		t.Fatalf("checkSpeak in a moderated room = %v, want %v", err, errModerated)
+	}
+	if err := reg.checkSpeak(rm, admin); err != nil {
+		t.Fatalf("the admin can not talk in a moderated room: %v", err)
+	}
+	if !reg.voice(rm, bob.identity()) || reg.voice(rm, bob.identity()) {
+		t.Fatal("voice does not report whether the client already had it")
+	}
+	if err := reg.checkSpeak(rm, bob); err != nil {
+		t.Fatalf("a voiced client can not talk in a moderated room: %v", err)
+	}
+	if !reg.devoice(rm, bob.identity()) || reg.checkSpeak(rm, bob) != errModerated {
+		t.Fatal("a devoiced client can still talk in a moderated room")
+	}
+}
+
+func TestRegistryKeyAndInvites(t *testing.T) {
+	reg := newRegistry()
+	admin := &client{username: "admin", guestID: "guest:1"}
+	bob := &client{username: "bob", guestID: "guest:2"}
+	carol := &client{username: "carol", guestID: "guest:3"}
+	reg.addClient(admin)
+	reg.addClient(bob)
+	reg.addClient(carol)
+	rm, _ := reg.createRoom("vault", admin, "s3cret")
+
+	if err := reg.joinRoom(admin, "vault", ""); err != nil {
+		t.Fatalf("the admin needs the key: %v", err)
+	}
+	if err := reg.joinRoom(bob, "vault", ""); err != errKeyRequired {
+		t.Fatalf("joinRoom without the key = %v, want %v", err, errKeyRequired)
+	}
+	if err := reg.joinRoom(bob, "vault", "guess"); err != errWrongKey {
+		t.Fatalf("joinRoom with a wrong key = %v, want %v", err, errWrongKey)
+	}
+	if err := reg.joinRoom(bob, "vault", "s3cret"); err != nil {
+		t.Fatalf("joinRoom with the key: %v", err)
+	}
+
+	// An invitation stands in for the key and is used up by joining
+	reg.invite(rm, carol.identity(), time.Now().Add(time.Hour))
+	if err := reg.joinRoom(carol, "vault", ""); err != nil {
+		t.Fatalf("joinRoom with an invitation: %v", err)
+	}
+	reg.quitRoom(carol, "vault")
+	if err := reg.joinRoom(carol, "vault", ""); err != errKeyRequired {
+		t.Fatalf("joinRoom after the invitation was used = %v, want %v", err, errKeyRequired)
+	}
+
+	reg.setInviteOnly(rm, true)
+	if err := reg.joinRoom(carol, "vault", "s3cret"); err != errInviteOnly {
+		t.Fatalf("joinRoom in an invite only room = %v, want %v", err, errInviteOnly)
+	}
+	reg.invite(rm, carol.identity(), time.Now().Add(-time.Second))
+	if err := reg.joinRoom(carol, "vault", ""); err != errInviteOnly {
+		t.Fatalf("joinRoom with an expired invitation = %v, want %v", err, errInviteOnly)
+	}
+	reg.invite(rm, carol.identity(), time.Now().Add(time.Hour))
+	if err := reg.joinRoom(carol, "vault", ""); err != nil {
+		t.Fatalf("joinRoom in an invite only room with an invitation: %v", err)
+	}
+}
@@ -2,561 +2,1121 @@ package internal
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
-	"math/big"
+	"io"
+	"math"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-// Port to open the serve and the protocol to be used
+// Default port to open the server on and the protocol to be used
 const (
 	PORT     string = ":8080"
 	PROTOCOL string = "tcp"
 )
 
-// Key pair for the server
-var (
-	serverPrivate *rsa.PrivateKey
-	serverPublic  rsa.PublicKey
+// Session log, registered accounts, room bans and identity key used by RunServer
+const (
+	logFileName      string = "../../logging/sessionHistory.txt"
+	accountsFileName string = "../../logging/accounts.json"
+	bansFileName     string = "../../logging/bans.json"
+	keyFileName      string = "../../logging/server_key.pem"
 )
 
+// How long an invitation to a room holds unless configured otherwise
+const defaultInviteTTL = 10 * time.Minute
+
+// Returned by handleUserConnection when the client sent nothing for the idle timeout
+var errIdleTimeout = errors.New("connection idle for too long")
+
+// How long RunServer waits for the handlers after the shutdown notice has run out
+const shutdownTimeout = 10 * time.Second
+
+// How long a client may take to finish the handshake and each attempt at a name, whatever the idle timeout is
+const handshakeTimeout = time.Minute
+
+// How long a write to a client may take. A client that stops reading is disconnected instead of blocking the sender
+const writeTimeout = 10 * time.Second
+
+// Returned by Serve and ListenAndServe once Shutdown has been called
+var ErrServerClosed = errors.New("chat server closed")
+
+// Settings for a Server. Zero values fall back to the defaults
+type Config struct {
+	Addr     string          // address to listen on, defaults to PORT
+	Protocol string          // network protocol, defaults to PROTOCOL
+	Key      *rsa.PrivateKey // identity key of the server, see LoadOrCreateKey. A temporary one is generated when nil
+	Log      io.Writer       // sink for the session log, discarded when nil
+
+	// Largest encoded message, in bytes, the server sends or accepts. Defaults to defaultMaxMessageSize when zero
+	MaxMessageSize int
+
+	// Usernames nobody can take, compared without case. Defaults to defaultReservedNames when nil
+	ReservedNames []string
+
+	// JSON file the registered accounts are kept in. Accounts are lost when the server stops if empty
+	AccountsFile string
+
+	// JSON file the room bans are kept in. Bans are lost when the server stops if empty
+	BansFile string
+
+	// Bans also keep out other users connecting from the IP address of the banned user
+	// Guests are always banned by their IP address, their guest id is gone once they reconnect
+	BanByIP bool
+
+	// Serves over TLS when set, see ServerTLSConfig. Clients on TLS may then skip the in-band key exchange
+	TLS *tls.Config
+
+	// How long Shutdown warns the clients before closing their connections
+	ShutdownNotice time.Duration
+
+	// How long the name, room and rights of a dropped connection are kept for the client to resume them
+	// A dropped connection is removed at once when zero
+	ResumeGrace time.Duration
+
+	// A client that sends nothing for IdleTimeout is evicted. The server pings every client each PingInterval,
+	// so a client that is still there always answers in time. Zero disables either
+	IdleTimeout  time.Duration
+	PingInterval time.Duration
+
+	// Joining a room that does not exist creates it with the joiner as admin instead of failing
+	AutoCreateRooms bool
+
+	// A room nobody is in is removed after EmptyRoomTTL. Rooms are kept until they are deleted when zero
+	EmptyRoomTTL time.Duration
+
+	// How long a kicked user has to wait before joining the room again. Kicked users can join again at once when zero
+	KickCooldown time.Duration
+
+	// How long an invitation to a room holds. Defaults to defaultInviteTTL when zero
+	InviteTTL time.Duration
+}
+
+// A chat server. Every server has its own clients, rooms and key, so several can run in one process
+type Server struct {
+	config Config
+	key    *rsa.PrivateKey
+
+	log   io.Writer
+	logMu sync.Mutex
+
+	reg      *registry
+	accounts *accountStore
+	bans     *banStore
+	guests   uint64 // last guest id given out
+
+	// Connections and the listener are tracked so Shutdown can close them
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
 // Each client is a struct that contains information about themselves
+// The username and identity are read by other connections, so they are guarded by mu
+// The rooms of a client are kept by the registry, see registry.roomsOf
 type client struct {
-	conn        net.Conn
-	username    string
-	currentRoom string
-	adminOf     []room
-	modOf       []room
-	public      rsa.PublicKey
+	conn    net.Conn
+	reader  *bufio.Reader
+	public  rsa.PublicKey
+	session *sessionKeys
+
+	mu       sync.Mutex
+	username string
+	account  string // account the client logged in to, empty for guests
+	guestID  string // identity of a guest, unique to the connection
+	token    string // resumes the session after the connection drops, see registry.hold
+
+	activeRoom string // room messages go to when none is named, guarded by the registry lock
 }
 
-// Each room is a struct that contains information about itself
+// Each room is a struct that contains information about itself, guarded by the registry lock
+// Rights are held by identities rather than clients, so they follow an account from one connection to the next
 type room struct {
-	roomAdmin        *client
-	roomName         string
-	connectedClients []*client
-	mods             []*client
+	roomAdmin string
+	roomName  string
+	members   []*client   // in the order they joined
+	mods      []string    // in the order they were promoted
+	expiry    *time.Timer // removes the room after it has been empty for the room TTL
+
+	cooldowns map[string]time.Time // identities kicked from the room and when they may join again
+
+	muted     map[string]time.Time // identities that can not talk in the room and until when, zero until they are unmuted
+	voiced    []string             // identities that can talk while the room is moderated
+	moderated bool                 // only mods and voiced identities can talk
+
+	keySalt    []byte // the room asks for a key when set, see hashRoomKey
+	keyHash    []byte
+	inviteOnly bool                 // only invited identities can join
+	invites    map[string]time.Time // invited identities and until when the invitation holds
+}
+
+// Returns the username of the client
+func (c *client) name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.username
 }
 
-var rooms []room
-var clients []*client
-var wg sync.WaitGroup
+// Returns the identity room rights are given to, the account for logged in clients and the guest id otherwise
+func (c *client) identity() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-var logFileName string = "../../logging/sessionHistory.txt"
+	if c.account != "" {
+		return accountIdentity(c.account)
+	}
+	return c.guestID
+}
 
-func newClient(conn net.Conn) {
-	wg.Add(1)
-	defer wg.Done()
+// Returns the name of the account the client logged in to, or an empty string for guests
+func (c *client) accountName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.account
+}
 
-	// First message from the user contains the selected username and a generated public key
-	name := setUsername(conn)
-	key := setPublicKeyClient(conn)
+// Returns the identity of an account
+func accountIdentity(name string) string {
+	return "account:" + nameKey(name)
+}
 
-	cli := &client{
-		conn:     conn,
-		username: name,
-		public:   key,
+// Creates a server from the config, generating a key pair if the config has none
+func NewServer(config Config) (*Server, error) {
+	if config.Addr == "" {
+		config.Addr = PORT
+	}
+	if config.Protocol == "" {
+		config.Protocol = PROTOCOL
+	}
+	if config.Log == nil {
+		config.Log = io.Discard
+	}
+	if config.ReservedNames == nil {
+		config.ReservedNames = defaultReservedNames
+	}
+	if config.InviteTTL <= 0 {
+		config.InviteTTL = defaultInviteTTL
+	}
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = defaultMaxMessageSize
+	}
+	if config.MaxMessageSize < minMaxMessageSize {
+		return nil, fmt.Errorf("the maximum message size has to be at least %d bytes", minMaxMessageSize)
 	}
 
-	clients = append(clients, cli)
+	// An idle client only sends the pongs to the pings of the server, or its own pings when the server sends none,
+	// so the idle timeout has to be longer than either or every idle client is evicted
+	if config.IdleTimeout > 0 {
+		if config.PingInterval > 0 && config.IdleTimeout <= config.PingInterval {
+			return nil, fmt.Errorf("the idle timeout of %s has to be longer than the ping interval of %s", config.IdleTimeout, config.PingInterval)
+		}
+		if config.PingInterval <= 0 && config.IdleTimeout <= pingInterval {
+			return nil, fmt.Errorf("the idle timeout of %s has to be longer than the %s between the pings of the clients when the server sends none", config.IdleTimeout, pingInterval)
+		}
+	}
 
-	// Server informs that a client is connected with username and the remote adress
-	fmt.Println(green("\nClient connected!"))
-	fmt.Println(blue("Name: "), blue(getUsername(conn)))
-	fmt.Println(cyan("Connection: "), cyan(conn.RemoteAddr().String()))
+	key := config.Key
+	if key == nil {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// Logs the connect action
-	logText := "Client connected: " + getUsername(conn) + ", Connection: " + conn.RemoteAddr().String()
-	writeLog(logText)
+	accounts, err := loadAccounts(config.AccountsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load accounts: %w", err)
+	}
 
-	// First message from the server to the clients contains a generated public key for the server
-	_, err := conn.Write([]byte(serverPublic.N.String() + " " + strconv.Itoa(serverPublic.E) + "\n"))
-	checkErrorServer(err, "")
+	bans, err := loadBans(config.BansFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load bans: %w", err)
+	}
 
-	handleUserConnection(conn)
+	s := &Server{
+		config:   config,
+		key:      key,
+		log:      config.Log,
+		reg:      newRegistry(),
+		accounts: accounts,
+		bans:     bans,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.reg.roomTTL = config.EmptyRoomTTL
+	s.reg.roomExpired = s.expireRoom
+	return s, nil
 }
 
-// Set the public key field for the client to be used as a decryption key for the future messages
-func setPublicKeyClient(conn net.Conn) rsa.PublicKey {
-	for {
-		userInput, err := bufio.NewReader(conn).ReadString('\n')
-		checkErrorServer(err, "")
+// Listens on the configured address and serves connections until Shutdown is called
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen(s.config.Protocol, s.config.Addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", s.config.Addr, err)
+	}
+	return s.Serve(ln)
+}
 
-		if userInput != "" {
-			userInput = strings.Trim(userInput, "\r\n")
-			args := strings.Split(userInput, " ")
-			N := strings.TrimSpace(args[0])
-			E := strings.TrimSpace(args[1])
+// Main loop that accepts connections from the listener and sends them to a goroutine that continiously monitors the socket and handles the requests
+// Serve takes ownership of the listener and always returns a non-nil error, ErrServerClosed after Shutdown
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	if s.config.TLS != nil {
+		ln = tls.NewListener(ln, s.config.TLS)
+	}
+	s.listener = ln
+	s.mu.Unlock()
 
-			var pKey rsa.PublicKey
-			i := new(big.Int)
+	defer ln.Close()
 
-			_, err := fmt.Sscan(N, i)
-			checkErrorServer(err, "")
+	fmt.Println(green("Server started on "), cyan(ln.Addr().String()))
+	fmt.Println(green("Server key fingerprint: "), cyan(fingerprint(&s.key.PublicKey)))
+	if s.config.TLS != nil {
+		fmt.Println(green("Serving over TLS"))
+	}
 
-			pKey.N = i
-			pKey.E, err = strconv.Atoi(E)
+	// Logs the session start time when the server is started
+	s.writeLog("Server started on " + ln.Addr().String() + " successfully")
 
-			if err != nil {
-				log.Println("error scanning value:", err)
+	var retryDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
 			}
 
-			return pKey
+			// Errors such as running out of file descriptors pass, so accepting is retried after a pause
+			if retryDelay == 0 {
+				retryDelay = 5 * time.Millisecond
+			} else if retryDelay *= 2; retryDelay > time.Second {
+				retryDelay = time.Second
+			}
+			fmt.Println(red("Unable to accept connection: "), err)
+			s.writeLog("Unable to accept connection: " + err.Error())
+			time.Sleep(retryDelay)
+			continue
 		}
+		retryDelay = 0
+
+		if !s.trackConn(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.newClient(conn)
 	}
 }
 
-// Set the username for a user that will be used as an identifier
-func setUsername(conn net.Conn) string {
+// Stops accepting connections and warns every client that the server is going down
+// After the notice period of the config the connections are closed, Shutdown waits for the handlers to return
+// and flushes the log, the accounts and the bans. If the context ends first the connections are closed at once,
+// its error is returned and the remaining handlers are left to finish on their own
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
 
-	for {
-		userInput, err := bufio.NewReader(conn).ReadString('\n')
-		checkErrorServer(err, "")
+	s.writeLog("Server shutting down")
 
-		if userInput != "" {
-			userInput = strings.Trim(userInput, "\n")
-			return userInput
+	if notice := s.config.ShutdownNotice; notice > 0 {
+		seconds := int(math.Ceil(notice.Seconds()))
+		s.notifyShutdown(ctx, "Server shutting down in "+strconv.Itoa(seconds)+" seconds")
+
+		timer := time.NewTimer(notice)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
 		}
 	}
 
+	// Clients are told the connection is closed on purpose, so they leave quietly instead of reporting an error
+	s.notifyShutdown(ctx, "Server is shutting down now")
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// Accounts are saved on every change, this catches a save that failed earlier
+	if saveErr := s.accounts.flush(); saveErr != nil {
+		fmt.Println(red("Unable to save accounts: "), saveErr)
+		s.writeLog("Unable to save accounts: " + saveErr.Error())
+	}
+	if saveErr := s.bans.flush(); saveErr != nil {
+		fmt.Println(red("Unable to save bans: "), saveErr)
+		s.writeLog("Unable to save bans: " + saveErr.Error())
+	}
+
+	s.writeLog("Server stopped")
+	s.syncLog()
+	return err
 }
 
-// Returns the username for a user, given a connection string
-func getUsername(conn net.Conn) string {
-	for i := 0; i < len(clients); i++ {
-		if clients[i].conn == conn {
-			return clients[i].username
-		}
+// Moves the read deadline of the connection to the idle timeout from now, or drops it when clients are never evicted
+func (s *Server) extendDeadline(conn net.Conn) {
+	if s.config.IdleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+	} else {
+		conn.SetReadDeadline(time.Time{})
 	}
+}
 
-	return "No username available"
+// Moves the read deadline of the connection to the handshake timeout from now
+// Unlike the idle timeout it always holds, so a connection that never finishes the handshake is dropped
+func extendHandshakeDeadline(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
 }
 
-// Returns a client, given a connection string
-func getClient(conn net.Conn) *client {
-	for i := 0; i < len(clients); i++ {
-		if clients[i].conn == conn {
-			return clients[i]
+// Pings the client every ping interval until stop is closed, the answer keeps the connection from timing out
+func (s *Server) keepAlive(cli *client, stop chan struct{}) {
+	if s.config.PingInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sendEnvelope(envelope{Type: msgPing, Sender: "SERVER"}, cli)
+		case <-stop:
+			return
 		}
 	}
-	return nil
 }
 
-// Returns a client, given a username
-func getClientByUsername(name string) *client {
-	for i := 0; i < len(clients); i++ {
-		if clients[i].username == name {
-			return clients[i]
-		}
+// Sends the shutdown notice to every client at once, so a client that stops reading does not hold up the others
+// Returns once every notice is written or the context ends
+func (s *Server) notifyShutdown(ctx context.Context, msg string) {
+	var sent sync.WaitGroup
+	for _, cli := range s.reg.clientList() {
+		sent.Add(1)
+		go func(cli *client) {
+			defer sent.Done()
+			s.sendEnvelope(envelope{Type: msgShutdown, Sender: "SERVER", Payload: msg}, cli)
+		}(cli)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sent.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
 	}
-	return nil
 }
 
-// Returns a room, given a room name
-func getRoom(roomName string) room {
-	for i := 0; i < len(rooms); i++ {
-		if rooms[i].roomName == roomName {
-			return rooms[i]
-		}
+// Returns the address the server is listening on, or nil before Serve is called
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
 	}
-	return room{nil, "", nil, nil}
+	return s.listener.Addr()
 }
 
-// Removes a client from the connected clients list, given a connection string
-func remove(conn net.Conn) {
-	for i := 0; i < len(clients); i++ {
-		if clients[i].conn == conn {
-			clients[i] = clients[len(clients)-1]
-			clients = clients[:len(clients)-1]
-		}
+// Reports whether Shutdown has been called
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Remembers an accepted connection so Shutdown can close it, and counts its handler. Returns false if the server is already closed
+// The handler is counted under the lock, so it can not be added after Shutdown started waiting for the handlers
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
 	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
 }
 
-// Main function that handles the commands, decrypts and splits the message and selects the action based on the command
-// First argument is the command
-func handleUserConnection(conn net.Conn) {
-	for {
-		// Waits for input from the clients
-		userInput, err := bufio.NewReader(conn).ReadString('\n')
+// Forgets a connection once its handler returns
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
 
-		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				fmt.Println("Connection closed with one user")
-			}
-			break
-		}
-
-		// decrypt using the server private key, trim the newline and split into a string array
-		userInput = decrypt(userInput, *serverPrivate)
-		userInput = strings.Trim(userInput, "\r\n")
-		args := strings.Split(userInput, " ")
-		cmd := strings.TrimSpace(args[0])
-
-		switch cmd {
-
-		// Set the username of the client to a new username
-		// Finds the user using the connection string and changes the username
-		case cmdName:
-			for i := 0; i < len(clients); i++ {
-				if clients[i].conn == conn {
-					newName := strings.TrimSpace(args[1])
-					logText := getUsername(conn) + " changed username to " + newName
-					writeLog(logText)
-					clients[i].username = newName
-					_, e := conn.Write([]byte("You changed your name to: " + newName))
-
-					if e != nil {
-						log.Fatalln("unable to write over client connection")
-					}
-				}
-			}
+func (s *Server) newClient(conn net.Conn) {
+	defer s.wg.Done()
+	defer s.untrackConn(conn)
 
-		// Sends a DM to the specified user. Second element in the args array is the destination username
-		// Uses that username as an identifier for sending the DM to the specified user
-		case cmdMsg:
-			destination := args[1]
-			if userInput != "" {
-				msg := strings.Join(args[2:], " ")
-				logText := "'" + getUsername(conn) + "'" + " WHISPER ->" + "'" + destination + "'" + ":" + msg
-				writeLog(logText)
-				sendClientMessage(msg, destination, getUsername(conn))
-			}
+	// A failure while handling one connection only closes that connection, the server keeps running
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println(red("Connection handler failed for "+conn.RemoteAddr().String()+":"), r)
+			s.writeLog(fmt.Sprint("Connection handler failed for ", conn.RemoteAddr().String(), ": ", r))
+		}
+		conn.Close()
+	}()
 
-		// Sends the message to all of the clients connected to the same room as the sender
-		case cmdBroadcast:
-			var owner string
-			for i := 0; i < len(clients); i++ {
-				if clients[i].conn == conn {
-					owner = clients[i].username
-				}
-			}
-			if userInput != "" {
-				msg := strings.Join(args[1:], " ")
-				logText := "'" + getUsername(conn) + "'" + " BROADCAST ->" + getClientByUsername(owner).currentRoom + ":" + msg
-				writeLog(logText)
-				broadcastMessage(conn, msg, owner, getUsername(conn))
-			}
+	// A client that stops answering during the handshake is dropped
+	extendHandshakeDeadline(conn)
 
-		// Create a new room specified by the name, which is the second element of the args array
-		case cmdCreateRoom:
-			roomName := strings.TrimSpace(args[1])
+	cli, token, err := s.handshake(conn)
+	if err != nil {
+		fmt.Println(red("Handshake failed with "+conn.RemoteAddr().String()+": "), err)
+		s.writeLog("Handshake failed with " + conn.RemoteAddr().String() + ": " + err.Error())
+		return
+	}
 
-			var destination string
-			var newRoom room
+	if err := s.register(cli, token); err != nil {
+		fmt.Println(red("Registration failed for "+conn.RemoteAddr().String()+": "), err)
+		s.writeLog("Registration failed for " + conn.RemoteAddr().String() + ": " + err.Error())
+		return
+	}
+	// A connection that drops without /exit can be resumed for a while
+	resumable, reason := true, "disconnected"
+	defer func() { s.disconnect(cli, resumable, reason) }()
 
-			newRoom.roomName = roomName
-			newRoom.roomAdmin = getClient(conn)
-			newRoom.mods = append(newRoom.mods, getClient(conn))
+	// Server informs that a client is connected with username and the remote adress
+	fmt.Println(green("\nClient connected!"))
+	fmt.Println(blue("Name: "), blue(cli.name()))
+	fmt.Println(cyan("Connection: "), cyan(conn.RemoteAddr().String()))
 
-			rooms = append(rooms, newRoom)
-			msg := "Room created with name: " + roomName
+	// Logs the connect action
+	logText := "Client connected: " + cli.name() + ", Connection: " + conn.RemoteAddr().String()
+	s.writeLog(logText)
+
+	stopPing := make(chan struct{})
+	defer close(stopPing)
+	go s.keepAlive(cli, stopPing)
+
+	err = s.handleUserConnection(cli)
+	if err == errClientExit {
+		resumable, reason = false, ""
+	} else if errors.Is(err, errIdleTimeout) {
+		// An idle connection is gone for good, the room is told it left
+		resumable, reason = false, "the connection timed out"
+
+		logText := "'" + cli.name() + "'" + " TIMED OUT AFTER " + s.config.IdleTimeout.String() + " IDLE"
+		s.writeLog(logText)
+		fmt.Println(cli.name() + " timed out")
+	} else if err != nil {
+		fmt.Println(red("Connection with "+cli.name()+" failed: "), err)
+		s.writeLog("'" + cli.name() + "'" + " CONNECTION FAILED: " + err.Error())
+	}
+}
 
-			logText := "'" + getUsername(conn) + "'" + " CREATED A ROOM ->" + "'" + roomName + "'"
-			writeLog(logText)
+// Exchanges keys with a new connection and returns the client, which is not registered yet
+func (s *Server) handshake(conn net.Conn) (*client, string, error) {
+	// Every read on the connection goes through one reader, so bytes buffered past a frame are kept for the next read
+	reader := bufio.NewReader(conn)
 
-			for i := 0; i < len(clients); i++ {
-				if clients[i].conn == conn {
-					destination = clients[i].username
-					clients[i].adminOf = append(clients[i].adminOf, newRoom)
-					clients[i].modOf = append(clients[i].modOf, newRoom)
-				}
-			}
+	// First message from the user contains the selected username and a generated public key
+	name, key, resume, err := s.readHello(reader)
+	if err != nil {
+		return nil, "", err
+	}
 
-			sendClientMessage(msg, destination, "SERVER")
+	cli := &client{
+		conn:     conn,
+		reader:   reader,
+		username: name,
+		guestID:  "guest:" + strconv.FormatUint(atomic.AddUint64(&s.guests, 1), 10),
+		public:   key,
+	}
 
-		// Join a room specified by the room name, which is the second element of the args array
-		case cmdJoinRoom:
-			var cli *client
-			roomName := strings.TrimSpace(args[1])
-			for i := 0; i < len(clients); i++ {
-				if clients[i].conn == conn {
-					cli = clients[i]
-					clients[i].currentRoom = roomName
+	// Second message from the server to the clients contains a generated public key for the server
+	serverKey, err := encodePublicKey(&s.key.PublicKey)
+	if err != nil {
+		return nil, "", err
+	}
 
-					logText := "'" + getUsername(conn) + "'" + " JOINED A ROOM ->" + "'" + roomName + "'"
-					writeLog(logText)
+	err = writeEnvelope(conn, envelope{Type: msgKey, Sender: "SERVER", Payload: serverKey}, nil, s.config.MaxMessageSize)
+	if err != nil {
+		return nil, "", err
+	}
 
-					sendClientMessage("You joined a room: '"+yellow(roomName)+"'", getUsername(conn), "SERVER")
-				}
-			}
+	// The client answers with an ephemeral key, the session keys for all further messages are agreed from it
+	cli.session, err = s.agreeSession(conn, reader)
+	if err != nil {
+		return nil, "", err
+	}
 
-			for i := 0; i < len(rooms); i++ {
-				if rooms[i].roomName == roomName {
-					rooms[i].connectedClients = append(rooms[i].connectedClients, cli)
-				}
-			}
+	// A client that reconnects sends the token of its dropped connection, once it can not be read by others
+	token := ""
+	if resume {
+		env, err := readEnvelope(reader, cli.session, s.config.MaxMessageSize)
+		if err != nil {
+			return nil, "", err
+		}
+		if env.Type != msgResume {
+			return nil, "", fmt.Errorf("expected %s, got %s", msgResume, env.Type)
+		}
+		token = env.Token
+	}
 
-		// Qui the current room, no second arguments are required
-		case cmdQuitRoom:
-			for i := 0; i < len(clients); i++ {
-				if clients[i].conn == conn {
-					logText := "'" + getUsername(conn) + "'" + " QUITTED A ROOM ->" + "'" + getClient(conn).currentRoom + "'"
-					writeLog(logText)
+	return cli, token, nil
+}
 
-					sendClientMessage("You quitted the room: '"+yellow(getClient(conn).currentRoom)+"'", getUsername(conn), "SERVER")
-					clients[i].currentRoom = ""
+// Number of usernames a new connection may try before it is closed
+const maxNameAttempts = 5
 
-				}
-			}
+// Registers the client under the name from its hello and tells the client the name it got
+// While the name is invalid, taken or belongs to an account whose password was not given, the reason is sent back
+// and the client may send another hello with a name and, for accounts, the password
+// A client that reconnects with the token of a held session gets its name, room and rights back instead
+func (s *Server) register(cli *client, resumeToken string) error {
+	token, err := newResumeToken()
+	if err != nil {
+		return err
+	}
 
-		// Promotes a member of the room, given that the promoter is the admin of the room
-		// O(N)^^3 code im so bad...
-		case cmdPromote:
-			currentRoom := getClient(conn).currentRoom
-			toPromote := strings.TrimSpace(args[1])
-			for i := 0; i < len(clients); i++ {
-				if clients[i].username == toPromote {
-					for _, v := range getClient(conn).adminOf {
-						if v.roomName == currentRoom {
-							for i := 0; i < len(rooms); i++ {
-								if rooms[i].roomName == currentRoom {
-									rooms[i].mods = append(rooms[i].mods, getClientByUsername(toPromote))
-									logText := "'" + toPromote + "'" + " PROMOTED TO A MOD BY->" + "'" + getClient(conn).username + "'" + " FOR ROOM -> " + "'" + rooms[i].roomName + "'"
-									writeLog(logText)
-								}
-							}
-							clients[i].modOf = append(clients[i].modOf, getRoom(currentRoom))
-							sendClientMessage("You have been promoted to a moderator by: "+getUsername(conn), clients[i].username, "SERVER")
-						}
-					}
-
-				}
-			}
+	// The name, room and rights of a dropped connection are given back if the token matches
+	resumed, replaced := false, (*client)(nil)
+	if resumeToken != "" {
+		resumed, replaced = s.reg.resume(cli, resumeToken, token)
+	}
+	if resumed {
+		// The old connection is dead even if it was not noticed yet, the client would not reconnect otherwise
+		if replaced != nil {
+			replaced.conn.Close()
+		}
 
-		// Broadcast message all in capitals, to all ussers
-		case cmdShout:
-			var owner string
-			for i := 0; i < len(clients); i++ {
-				if clients[i].conn == conn {
-					owner = clients[i].username
-				}
-			}
-			if userInput != "" {
-				msg := strings.ToUpper(strings.Join(args[1:], " "))
-				logText := "'" + getUsername(conn) + "'" + " SHOUT ->" + getClientByUsername(owner).currentRoom
-				writeLog(logText)
-				broadcastMessage(conn, msg, owner, getUsername(conn))
+		// Bans given while the connection was down take effect now
+		for _, roomName := range s.reg.roomsOf(cli) {
+			if rm := s.reg.room(roomName); rm != nil && s.checkBan(roomName, cli) != nil {
+				s.reg.kick(rm, cli, 0)
 			}
+		}
+
+		rooms := s.reg.roomsOf(cli)
+		logText := "'" + cli.name() + "'" + " RESUMED THEIR SESSION"
+		s.writeLog(logText)
 
-		// Kicks a user from the room, given that the kicker is either an admin or a mod of the room
-		case cmdKick:
-			kicker := getClient(conn)
-			currentRoom := kicker.currentRoom
-			toKick := strings.TrimSpace(args[1])
-
-			for i := 0; i < len(clients); i++ {
-				if clients[i].username != toKick {
-					continue
-				}
-
-				for _, v := range getClient(conn).adminOf {
-					if v.roomName == currentRoom {
-						logText := "'" + getUsername(conn) + "'" + " KICKED " + "'" + clients[i].username + "'" + " FROM ROOM ->" + "'" + clients[i].currentRoom + "'"
-						writeLog(logText)
-						clients[i].currentRoom = ""
-
-						sendClientMessage("You have been kicked from '"+currentRoom+"' by: "+getUsername(conn), kicker.username, "SERVER")
-					}
-				}
+		msg := "Reconnected as " + cli.name()
+		if len(rooms) > 0 {
+			msg += ", back in " + quoteNames(rooms) + ", talking in '" + s.reg.activeRoom(cli) + "'"
+		}
+		for _, roomName := range rooms {
+			s.announceRoom(roomName, "'"+cli.name()+"' reconnected", cli)
+		}
+		s.sendEnvelope(envelope{Type: msgUsername, Sender: cli.name(), Token: token, Payload: msg}, cli)
+		return nil
+	}
+
+	cli.mu.Lock()
+	cli.token = token
+	cli.mu.Unlock()
+
+	password := ""
+	for attempt := 1; ; attempt++ {
+		err := s.claimName(cli, password)
+		if err == nil {
+			// A client that asked to resume thinks it is still in its rooms, it has to be told they are gone
+			msg := ""
+			if resumeToken != "" {
+				msg = "Reconnected as " + cli.name() + ", but the session could not be resumed, it ran out or the server restarted. " +
+					"You are not in any room, join them again with " + cmdJoinRoom
 			}
+			s.sendEnvelope(envelope{Type: msgUsername, Sender: cli.name(), Token: token, Payload: msg}, cli)
+			return nil
+		}
+
+		code := errCodeNameRejected
+		var cmdErr *commandError
+		if errors.As(err, &cmdErr) {
+			code = cmdErr.code
+		}
 
-			if isMod(getRoom(currentRoom).mods, kicker.username) && !isMod(getRoom(currentRoom).mods, toKick) {
-				logText := "'" + getUsername(conn) + "'" + " KICKED " + "'" + toKick + "'" + " FROM ROOM ->" + "'" + currentRoom + "'"
-				writeLog(logText)
+		s.sendError(code, err.Error(), cli)
+		if attempt == maxNameAttempts {
+			return errors.New("too many rejected usernames")
+		}
 
-				getClientByUsername(toKick).currentRoom = ""
-				sendClientMessage("You have been kicked from '"+currentRoom+"' by: "+getUsername(conn), toKick, "SERVER")
+		// Typing another name or a password can take a while, every attempt gets the whole handshake timeout
+		extendHandshakeDeadline(cli.conn)
+		env, err := readEnvelope(cli.reader, cli.session, s.config.MaxMessageSize)
+		if err != nil {
+			return err
+		}
+		if env.Type != msgHello {
+			return fmt.Errorf("expected %s, got %s", msgHello, env.Type)
+		}
 
-			}
+		cli.mu.Lock()
+		cli.username = cleanName(env.Sender)
+		cli.mu.Unlock()
+		password = env.Payload
+	}
+}
 
-		// Spams the message to the server 'N' times. Number of times to spam is the second element of the args array
-		case cmdSpam:
-			var owner string
-			for i := 0; i < len(clients); i++ {
-				if clients[i].conn == conn {
-					owner = clients[i].username
-				}
-			}
-			if userInput != "" {
-				spamCount, _ := strconv.Atoi(strings.TrimSpace(args[1]))
-				msg := strings.Join(args[2:], " ")
+// Checks the username of a new client and registers it. Account names are only given out with the right password
+func (s *Server) claimName(cli *client, password string) error {
+	name := cli.name()
+	if err := validateName(name, s.config.ReservedNames); err != nil {
+		return err
+	}
 
-				for i := 0; i < spamCount; i++ {
-					broadcastMessage(conn, msg, owner, getUsername(conn))
-					time.Sleep(250 * time.Millisecond)
-				}
+	if s.accounts.exists(name) {
+		if password == "" {
+			return &commandError{errCodeAuthRequired, "username '" + name + "' is registered, enter its password"}
+		}
 
-				logText := "'" + getUsername(conn) + "'" + " SPAMMED " + msg + " " + strings.TrimSpace(args[1]) + " Times"
-				writeLog(logText)
-			}
+		accountName, err := s.accounts.authenticate(name, password)
+		if err != nil {
+			return &commandError{errCodeAuthRequired, err.Error()}
+		}
 
-		// Lists the active users or lists the active users in a room. If listing for room, a room name is required
-		case cmdList:
-			var activeUsers string
-			if len(args) == 1 {
-				for i := 0; i < len(clients); i++ {
-					activeUsers += "'" + clients[i].username + "'" + " "
-				}
-
-				sendClientMessage(yellow(activeUsers), getUsername(conn), "SERVER: Active users are")
-				checkErrorServer(err, "unable to write over client connection")
-
-			} else if len(args) == 2 {
-				for i := 0; i < len(clients); i++ {
-					if clients[i].currentRoom == args[1] {
-						activeUsers += "'" + clients[i].username + "'" + " "
-					}
-				}
-
-				sendClientMessage(yellow(activeUsers), getUsername(conn), "SERVER: Active users in '"+getRoom(args[1]).roomName+"' are")
-				checkErrorServer(err, "unable to write over client connection")
-			}
+		cli.mu.Lock()
+		cli.username = accountName
+		cli.account = accountName
+		cli.mu.Unlock()
+	}
+
+	return s.reg.addClient(cli)
+}
 
-		// Lists the active rooms for the server
-		case cmdListRooms:
-			var activeRooms string
-			for i := 0; i < len(rooms); i++ {
-				activeRooms += "'" + rooms[i].roomName + "'" + " "
+// Removes a client that left or whose connection failed from the clients and its rooms, telling the rooms why it left
+// A dropped connection that did not leave with /exit is held for the resume grace period instead
+func (s *Server) disconnect(cli *client, resumable bool, reason string) {
+	cli.conn.Close()
+
+	// The client can come back with its token, the name, rooms and rights wait for it until the grace period ends
+	if resumable && s.config.ResumeGrace > 0 && !s.isClosed() {
+		rooms := s.reg.roomsOf(cli)
+		if s.reg.hold(cli, s.config.ResumeGrace, s.expireHeld) {
+			logText := "'" + cli.name() + "'" + " CONNECTION LOST, HELD FOR " + s.config.ResumeGrace.String()
+			s.writeLog(logText)
+			fmt.Println(cli.name() + " lost the connection")
+
+			for _, roomName := range rooms {
+				s.announceRoom(roomName, "'"+cli.name()+"' lost the connection", nil)
 			}
-			sendClientMessage(yellow(activeRooms), getUsername(conn), "SERVER: Active rooms are")
-			checkErrorServer(err, "unable to write over client connection")
+			return
+		}
+	}
 
-		case cmdHelp:
+	rooms := s.reg.removeClient(cli)
 
-		// Disconnects from the server
-		case cmdExit:
-			name := getUsername(conn)
-			remove(conn)
+	logText := "'" + cli.name() + "'" + " DISCONNECTED"
+	s.writeLog(logText)
+	fmt.Println(cli.name() + " disconnected")
 
-			err := conn.Close()
-			checkErrorServer(err, "")
+	for _, roomName := range rooms {
+		s.announceLeave(roomName, cli.name(), reason)
+		s.handOver(roomName, cli.identity())
+	}
+}
 
-			logText := "'" + name + "'" + " DISCONNECTED"
-			writeLog(logText)
-			fmt.Println(name + " disconnected")
+// Called when a held session was not resumed in time, the rooms it was in are told it left
+func (s *Server) expireHeld(name string, identity string, rooms []string) {
+	logText := "'" + name + "'" + " DISCONNECTED"
+	s.writeLog(logText)
+	fmt.Println(name + " disconnected")
 
-		default:
-			fmt.Println("No such command: ", cmd)
-		}
+	for _, roomName := range rooms {
+		s.announceLeave(roomName, name, "the connection was not resumed")
+		s.handOver(roomName, identity)
+	}
+}
 
+// Hands the room over if the identity that left it was its admin, and tells the room who the new admin is
+func (s *Server) handOver(roomName string, leaving string) {
+	next := s.reg.handOver(roomName, leaving)
+	if next == nil {
+		return
 	}
+
+	logText := "'" + next.name() + "'" + " TOOK OVER ROOM ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+
+	s.announceRoom(roomName, "'"+next.name()+"' is the admin of the room now", next)
+	s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: "The admin left, you are the admin of the room now"}, next)
 }
 
-// Writes a message to the client using a connection. Destination connection string determined by destination username
-func sendClientMessage(msg string, destination string, sender string) {
-	for i := 0; i < len(clients); i++ {
-		if clients[i].username == destination {
-			cipherText := encrypt(blue(sender)+blue(": ")+msg, clients[i].public)
+// Called when a room was removed after nobody was in it for the room TTL
+func (s *Server) expireRoom(roomName string) {
+	logText := "ROOM EXPIRED ->" + "'" + roomName + "'"
+	s.writeLog(logText)
+}
 
-			_, err := clients[i].conn.Write([]byte(cipherText + "\n"))
-			checkErrorServer(err, "unable to write over client connection")
-		}
+// Reads the hello message of a new connection, which carries the username and the public key of the client
+func (s *Server) readHello(reader *bufio.Reader) (string, rsa.PublicKey, bool, error) {
+	env, err := readEnvelope(reader, nil, s.config.MaxMessageSize)
+	if err != nil {
+		return "", rsa.PublicKey{}, false, err
+	}
+
+	if env.Type != msgHello {
+		return "", rsa.PublicKey{}, false, fmt.Errorf("expected %s, got %s", msgHello, env.Type)
+	}
+
+	key, err := decodePublicKey(env.Payload)
+	if err != nil {
+		return "", rsa.PublicKey{}, false, fmt.Errorf("error decoding public key: %w", err)
 	}
 
+	return cleanName(env.Sender), key, env.Resume, nil
 }
 
-// Sends message to all clients that are in the same room. Who to send is filtered by checking the current room of the user and each client's current room
-func broadcastMessage(conn net.Conn, msg string, owner string, sender string) {
-	var senderRoom string = ""
-	for i := 0; i < len(clients); i++ {
-		if clients[i].conn == conn {
-			senderRoom = clients[i].currentRoom
+// Agrees on the session keys with the ephemeral key of the client
+// The ephemeral key of the server is signed with the server key so the client knows it is talking to the pinned server
+func (s *Server) agreeSession(conn net.Conn, reader *bufio.Reader) (*sessionKeys, error) {
+	env, err := readEnvelope(reader, nil, s.config.MaxMessageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.Type != msgSession {
+		return nil, fmt.Errorf("expected %s, got %s", msgSession, env.Type)
+	}
+
+	// Over TLS the client may leave the key exchange out, the connection is then only protected by TLS
+	if env.Payload == "" {
+		if !isTLS(conn) {
+			return nil, errors.New("the key exchange can only be skipped over TLS")
 		}
+		return nil, writeEnvelope(conn, envelope{Type: msgSession, Sender: "SERVER"}, nil, s.config.MaxMessageSize)
+	}
+
+	priv, pub, err := newEphemeralKey()
+	if err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < len(clients); i++ {
-		if clients[i].username != owner && clients[i].currentRoom == senderRoom {
-			cipherText := encrypt(blue(sender)+blue(": ")+msg, clients[i].public)
+	key, clientPub, err := agreeKey(priv, env.Payload, false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to agree on a session key: %w", err)
+	}
 
-			_, err := clients[i].conn.Write([]byte(cipherText + "\n"))
-			checkErrorServer(err, "unable to write over client connection")
+	sig, err := signHandshake(s.key, clientPub, pub)
+	if err != nil {
+		return nil, err
+	}
 
-		}
+	err = writeEnvelope(conn, envelope{Type: msgSession, Sender: "SERVER", Payload: base64.StdEncoding.EncodeToString(pub), Signature: sig}, nil, s.config.MaxMessageSize)
+	if err != nil {
+		return nil, err
 	}
 
+	return newSessionKeys(key)
 }
 
-// Checks whether the given user is a moderator for the room. The client array passed to this function is the mods array of a room object
-func isMod(r []*client, user string) bool {
-	for i := 0; i < len(r); i++ {
-		if r[i].username == user {
+// Main function that handles the commands, decrypts the message and selects the action based on the command
+// First argument is the command
+// Returns errClientExit when the client leaves with /exit, errIdleTimeout when it sends nothing for the idle timeout,
+// nil when the connection is closed, and the error if reading fails in any other way
+func (s *Server) handleUserConnection(cli *client) error {
+	for {
+		// Waits for input from the clients, for at most the idle timeout
+		s.extendDeadline(cli.conn)
+		frame, err := readFrame(cli.reader, s.config.MaxMessageSize)
+		if err == errMessageTooLarge {
+			s.sendError(errCodeTooLarge, "The message is larger than the limit of the server, "+strconv.Itoa(s.config.MaxMessageSize)+" bytes", cli)
+			continue
+		}
 
-			return true
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return errIdleTimeout
+			}
+			return err
+		}
+
+		// decrypt using the session key of the client and decode the command envelope
+		env, err := decodeEnvelope(frame, cli.session, s.config.MaxMessageSize)
+		if err != nil {
+			fmt.Println("Unable to decode message from", cli.name()+":", err)
+			if err == errMessageTooLarge {
+				s.sendError(errCodeTooLarge, err.Error(), cli)
+			}
+			continue
+		}
+
+		switch env.Type {
+		case msgCommand:
+			if err := s.runCommand(cli, env); err == errClientExit {
+				return err
+			}
+		case msgKeyRequest:
+			s.sendPublicKey(env.Payload, cli)
+		case msgDirect:
+			s.relayDirect(cli, env)
+		case msgRekey:
+			s.rekey(cli, env.Payload)
+		case msgPing:
+			s.sendEnvelope(envelope{Type: msgPong, Sender: "SERVER"}, cli)
+		case msgPong:
+			// Reading it already moved the deadline
+		default:
+			fmt.Println("Unexpected message type from", cli.name()+":", env.Type)
 		}
 	}
-	return false
 }
 
-// Writes to the log file for session logging
-func writeLog(logText string) {
-	fo, err := os.OpenFile(logFileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-	checkErrorServer(err, "error opening log file")
+// Answers a rekey started by the client. The answer goes out with the current key, the new key is used after it
+func (s *Server) rekey(cli *client, peer string) {
+	if cli.session == nil {
+		s.sendError(errCodeRekeyFailed, "The session has no in-band encryption to rekey", cli)
+		return
+	}
 
-	currentTime := time.Now()
-	date := (currentTime.Format("\n[2006-01-02 15:04:0]"))
+	pub, key, err := answerRekey(peer)
+	if err != nil {
+		fmt.Println("Unable to rekey the session of", cli.name()+":", err)
+		s.sendError(errCodeRekeyFailed, "Unable to rekey the session", cli)
+		return
+	}
 
-	_, err = fo.WriteString(date + "          " + logText)
+	s.sendEnvelope(envelope{Type: msgRekey, Sender: "SERVER", Payload: pub}, cli)
+	if err := cli.session.rotate(key); err != nil {
+		fmt.Println("Unable to rekey the session of", cli.name()+":", err)
+		cli.conn.Close()
+	}
+}
 
-	fo.Close()
-	checkErrorServer(err, "")
+// Sends the public key of a user so the client can encrypt direct messages to them
+// An empty payload tells the client there is no such user
+func (s *Server) sendPublicKey(name string, destination *client) {
+	env := envelope{Type: msgPublicKey, Sender: name}
+	if owner := s.reg.client(name); owner != nil {
+		key, err := encodePublicKey(&owner.public)
+		if err != nil {
+			s.sendError(errCodeFailed, "Unable to send the key of "+name, destination)
+			return
+		}
+		env.Sender = owner.name()
+		env.Payload = key
+	}
+	s.sendEnvelope(env, destination)
 }
 
-func checkErrorServer(err error, errMsg string) {
+// Passes an end to end encrypted direct message on to the recipient without reading it
+// Only who sent it to whom and its size are logged, the server can not see the text
+func (s *Server) relayDirect(cli *client, env envelope) {
+	destination := s.reg.client(env.To)
+	if destination == nil {
+		s.sendError(errCodeNotFound, "No such user: "+env.To, cli)
+		return
+	}
+
+	logText := "'" + cli.name() + "'" + " WHISPER ->" + "'" + destination.name() + "'" + " (" + strconv.Itoa(len(env.Payload)) + " bytes, end-to-end encrypted)"
+	s.writeLog(logText)
+	s.sendEnvelope(envelope{Type: msgDirect, Sender: cli.name(), To: destination.name(), Payload: env.Payload}, destination)
+}
+
+// Sends an information message from the server to the client
+func (s *Server) sendNotice(msg string, destination *client) {
+	s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Payload: msg}, destination)
+}
+
+// Tells the client that their request failed. The code is one of the errCode constants
+func (s *Server) sendError(code string, msg string, destination *client) {
+	s.sendEnvelope(envelope{Type: msgError, Sender: "SERVER", Code: code, Payload: msg}, destination)
+}
+
+// Encrypts the envelope with the session key of the client and writes it to their connection
+// A failed or timed out write closes the connection of the destination, whose own goroutine then removes it
+func (s *Server) sendEnvelope(env envelope, destination *client) {
+	destination.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err := writeEnvelope(destination.conn, env, destination.session, s.config.MaxMessageSize)
+	if err == errMessageTooLarge {
+		fmt.Println("Message for", destination.name(), "is too large to send")
+		return
+	}
 	if err != nil {
-		fmt.Println(errMsg + err.Error())
-		os.Exit(0)
+		fmt.Println(red("Unable to write to "+destination.name()+": "), err)
+		s.writeLog("Unable to write to '" + destination.name() + "': " + err.Error())
+		destination.conn.Close()
 	}
 }
 
-// Main function that handles server connections in a loop
-func RunServer() {
-	fmt.Println("Server starting...")
-	ln, err := net.Listen(PROTOCOL, PORT)
-	checkErrorServer(err, "Error listening on port")
+// Sends message to all other members of the room
+// Returns the reason if the sender can not talk in the room, because it left, is muted or the room is moderated
+func (s *Server) broadcastMessage(sender *client, roomName string, msg string) error {
+	if !s.reg.isMember(roomName, sender) {
+		return errNotMember
+	}
+	if err := s.reg.checkSpeak(s.reg.room(roomName), sender); err != nil {
+		return err
+	}
 
-	// Generates a public and private key pair for the server
-	private, err := rsa.GenerateKey(rand.Reader, 2048)
-	checkErrorServer(err, " Unable to generate private key")
+	env := envelope{Type: msgChat, Sender: sender.name(), Room: roomName, Payload: msg}
+	for _, c := range s.reg.roomClients(roomName) {
+		if c != sender {
+			s.sendEnvelope(env, c)
+		}
+	}
+	return nil
+}
 
-	serverPrivate = private
-	serverPublic = serverPrivate.PublicKey
+// Sends a notice from the server to every client in the room except the one it is about
+func (s *Server) announceRoom(roomName string, msg string, except *client) {
+	for _, c := range s.reg.roomClients(roomName) {
+		if c != except {
+			s.sendEnvelope(envelope{Type: msgNotice, Sender: "SERVER", Room: roomName, Payload: msg}, c)
+		}
+	}
+}
 
-	defer ln.Close()
+// Tells the room that a user left it, and why if a reason is given
+func (s *Server) announceLeave(roomName string, name string, reason string) {
+	msg := "'" + name + "' left the room"
+	if reason != "" {
+		msg += ", " + reason
+	}
+	s.announceRoom(roomName, msg, nil)
+}
 
-	// Creates a log file for session logging
-	fo, err := os.Create(logFileName)
-	checkErrorServer(err, "")
+// Writes what is buffered for the log sink to disk, if the sink is a file
+func (s *Server) syncLog() {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
 
-	fmt.Println(green("Server started on port "), cyan(PORT))
+	if f, ok := s.log.(interface{ Sync() error }); ok {
+		if err := f.Sync(); err != nil {
+			fmt.Println("error syncing log: " + err.Error())
+		}
+	}
+}
+
+// Writes to the log sink for session logging
+func (s *Server) writeLog(logText string) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
 
-	// Logs the session start time when the server is started
 	currentTime := time.Now()
-	date := (currentTime.Format("[2006-01-02 15:04:0]"))
-	l, err := fo.WriteString(date + "          Server started on port " + PORT + " successfully")
+	date := (currentTime.Format("\n[2006-01-02 15:04:0]"))
 
-	if l == 0 {
-		fmt.Println("Write error")
+	_, err := io.WriteString(s.log, date+"          "+logText)
+	if err != nil {
+		fmt.Println("error writing log: " + err.Error())
 	}
+}
 
+// Stops the process for errors the server can not start without
+func checkErrorServer(err error, errMsg string) {
 	if err != nil {
-		fmt.Println(err)
-		fo.Close()
-		return
+		fmt.Println(errMsg + err.Error())
+		os.Exit(1)
 	}
+}
 
-	// Main loop that accepts connections and sends them to a goroutine that continiously monitors the socket and handles the requests
-	for {
-		conn, err := ln.Accept()
-		checkErrorServer(err, "Unable to connect to client: ")
+// Main function that starts a server on the default port, logging the session to the log file
+func RunServer(settings ServerSettings) {
+	fmt.Println("Server starting...")
 
-		go newClient(conn)
+	// Creates a log file for session logging
+	fo, err := os.Create(settings.LogFile)
+	checkErrorServer(err, "")
+	defer fo.Close()
+
+	// The identity key is kept across restarts so clients can pin it
+	key, err := LoadOrCreateKey(settings.KeyFile)
+	checkErrorServer(err, "Unable to load server key: ")
+
+	tlsConfig, err := ServerTLSConfig(settings.TLS)
+	checkErrorServer(err, "Unable to set up TLS: ")
+
+	server, err := NewServer(Config{
+		Addr:           settings.Addr(),
+		Key:            key,
+		Log:            fo,
+		AccountsFile:   settings.AccountsFile,
+		BansFile:       settings.BansFile,
+		BanByIP:        settings.BanByIP,
+		TLS:            tlsConfig,
+		ShutdownNotice: time.Duration(settings.ShutdownNotice) * time.Second,
+		ResumeGrace:    time.Duration(settings.ResumeGrace) * time.Second,
+		IdleTimeout:    time.Duration(settings.IdleTimeout) * time.Second,
+		PingInterval:   time.Duration(settings.PingInterval) * time.Second,
+
+		AutoCreateRooms: settings.AutoCreateRooms,
+		EmptyRoomTTL:    time.Duration(settings.EmptyRoomTTL) * time.Second,
+		KickCooldown:    time.Duration(settings.KickCooldown) * time.Second,
+		InviteTTL:       time.Duration(settings.InviteTTL) * time.Second,
+		MaxMessageSize:  settings.MaxMessageSize,
+		ReservedNames:   settings.reservedNames(),
+	})
+	checkErrorServer(err, "Unable to create server: ")
+
+	// The first SIGINT or SIGTERM shuts the server down gracefully, a second one exits at once
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		sig := <-signals
+		fmt.Println(yellow("\nReceived " + sig.String() + ", shutting down..."))
+
+		go func() {
+			<-signals
+			fmt.Println(red("Forced exit"))
+			os.Exit(1)
+		}()
+
+		timeout := time.Duration(settings.ShutdownNotice)*time.Second + shutdownTimeout
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			fmt.Println(red("Shutdown did not finish: "), err)
+			return
+		}
+		fmt.Println(green("Server stopped"))
+	}()
 
+	err = server.ListenAndServe()
+	if err != ErrServerClosed {
+		checkErrorServer(err, "")
 	}
+	<-stopped
 }
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// A server serving on a listener of its own, and the result of Serve once it returned
+type testServer struct {
+	*Server
+	addr   string
+	served chan error
+}
+
+// Starts a server on a free port of the loopback interface
+func startTestServer(t *testing.T) *testServer {
+	t.Helper()
+	s, err := NewServer(Config{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	ts := &testServer{Server: s, addr: ln.Addr().String(), served: make(chan error, 1)}
+	go func() { ts.served <- s.Serve(ln) }()
+	return ts
+}
+
+// A connection that went through the handshake the way the client does it
+type testConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	session *sessionKeys
+}
+
+func (c *testConn) send(env envelope) error {
+	return writeEnvelope(c.conn, env, c.session, defaultMaxMessageSize)
+}
+
+func (c *testConn) read() (envelope, error) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return readEnvelope(c.reader, c.session, defaultMaxMessageSize)
+}
+
+// Connects to the server, checks that its key signed the key exchange and registers the name
+func dialTestServer(t *testing.T, ts *testServer, key *rsa.PrivateKey, name string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	clientKey, _ := encodePublicKey(&key.PublicKey)
+	if err := c.send(envelope{Type: msgHello, Sender: name, Payload: clientKey}); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+
+	env, err := c.read()
+	if err != nil || env.Type != msgKey {
+		t.Fatalf("read server key = %v, %v", env.Type, err)
+	}
+	serverKey, err := decodePublicKey(env.Payload)
+	if err != nil || !serverKey.Equal(&ts.key.PublicKey) {
+		t.Fatalf("the server sent a key that is not its own: %v", err)
+	}
+
+	priv, pub, _ := newEphemeralKey()
+	if err := c.send(envelope{Type: msgSession, Sender: name, Payload: base64.StdEncoding.EncodeToString(pub)}); err != nil {
+		t.Fatalf("session: %v", err)
+	}
+	env, err = c.read()
+	if err != nil || env.Type != msgSession {
+		t.Fatalf("read session = %v, %v", env.Type, err)
+	}
+	keys, serverPub, err := agreeKey(priv, env.Payload, true)
+	if err != nil {
+		t.Fatalf("agreeKey: %v", err)
+	}
+	if err := verifyHandshake(&serverKey, pub, serverPub, env.Signature); err != nil {
+		t.Fatalf("the key exchange is not signed by the server key: %v", err)
+	}
+	c.session, _ = newSessionKeys(keys)
+
+	env, err = c.read()
+	if err != nil || env.Type != msgUsername || env.Sender != name {
+		t.Fatalf("registration = %+v, %v", env, err)
+	}
+	return c
+}
+
+func TestTwoServersInOneProcess(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := startTestServer(t), startTestServer(t)
+	if first.addr == second.addr || first.key.Equal(second.key) {
+		t.Fatal("the servers share an address or a key")
+	}
+
+	// Each server has its own clients, so the same name is free on both
+	a := dialTestServer(t, first, key, "alice")
+	b := dialTestServer(t, second, key, "alice")
+
+	for _, c := range []*testConn{a, b} {
+		if err := c.send(envelope{Type: msgPing}); err != nil {
+			t.Fatalf("ping: %v", err)
+		}
+		if env, err := c.read(); err != nil || env.Type != msgPong {
+			t.Fatalf("answer to a ping = %v, %v", env.Type, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := first.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case err := <-first.served:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Fatalf("Serve = %v, want %v", err, ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Shutdown")
+	}
+
+	// The client of the stopped server is told, then its connection is closed
+	if env, err := a.read(); err != nil || env.Type != msgShutdown {
+		t.Fatalf("read after Shutdown = %v, %v, want %s", env.Type, err, msgShutdown)
+	}
+	if _, err := a.read(); err == nil {
+		t.Fatal("the connection is still open after Shutdown")
+	}
+
+	// The other server is not affected
+	if err := b.send(envelope{Type: msgPing}); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if env, err := b.read(); err != nil || env.Type != msgPong {
+		t.Fatalf("the second server stopped answering: %v, %v", env.Type, err)
+	}
+
+	if err := second.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-second.served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve = %v, want %v", err, ErrServerClosed)
+	}
+
+	// A closed server does not serve again
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	if err := first.Serve(ln); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve after Shutdown = %v, want %v", err, ErrServerClosed)
+	}
+}
@@ -0,0 +1,315 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// How often the client agrees on a new session key with the server
+// Once a key is replaced and forgotten, traffic recorded under it can not be decrypted even with the long-term keys
+var rekeyInterval = 10 * time.Minute
+
+// Sizes of the epoch and the counter written in front of every encrypted frame
+const (
+	epochSize   = 4
+	counterSize = 8
+	frameHead   = epochSize + counterSize
+)
+
+// Labels that keep the derived keys and signatures of this protocol apart from any other use of the same keys
+// Each direction has its own key, so a frame can not be sent back to the side that sealed it
+const (
+	initiatorKeyInfo = "chat_server session key initiator to responder"
+	responderKeyInfo = "chat_server session key responder to initiator"
+	handshakeContext = "chat_server handshake"
+)
+
+// The keys of one epoch as seen from one side, the key it seals with and the key it opens with
+type directionKeys struct {
+	send []byte
+	recv []byte
+}
+
+// The ciphers of one epoch and the counters of both directions
+// Every frame carries its counter, which is the nonce too, and a frame whose counter is not above the last one is a replay
+type epochCiphers struct {
+	send     cipher.AEAD
+	recv     cipher.AEAD
+	sent     uint64 // counter of the next frame sealed
+	received uint64 // lowest counter the next frame opened may have
+}
+
+// Symmetric keys of a connection. Each rekey moves to a new epoch. The keys of the previous epoch are kept
+// so that frames the other side sent before it switched can still be read
+type sessionKeys struct {
+	mu       sync.Mutex
+	epoch    uint32
+	current  *epochCiphers
+	previous *epochCiphers
+	pending  []byte // private half of a rekey this side started, until the other side answers
+
+	// Held from sealing a frame until it is written, so frames go out in the order of their counters
+	writeMu sync.Mutex
+}
+
+// Creates the ciphers of an epoch from its keys
+func newEpochCiphers(keys directionKeys) (*epochCiphers, error) {
+	send, err := newSession(keys.send)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newSession(keys.recv)
+	if err != nil {
+		return nil, err
+	}
+	return &epochCiphers{send: send, recv: recv}, nil
+}
+
+// Creates the session keys of a connection, starting at epoch 0
+func newSessionKeys(keys directionKeys) (*sessionKeys, error) {
+	ciphers, err := newEpochCiphers(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionKeys{current: ciphers}, nil
+}
+
+// Encrypts a frame with the send key of the current epoch. The epoch and the counter are written in front
+// so the receiver knows which key to use and can refuse frames it has seen before
+func (k *sessionKeys) seal(msg []byte) ([]byte, error) {
+	k.mu.Lock()
+	epoch, ciphers := k.epoch, k.current
+	counter := ciphers.sent
+	ciphers.sent++
+	k.mu.Unlock()
+
+	head := make([]byte, frameHead)
+	binary.BigEndian.PutUint32(head, epoch)
+	binary.BigEndian.PutUint64(head[epochSize:], counter)
+
+	out := make([]byte, frameHead, frameHead+len(msg)+ciphers.send.Overhead())
+	copy(out, head)
+	return ciphers.send.Seal(out, counterNonce(counter, ciphers.send), msg, head), nil
+}
+
+// Decrypts a frame with the receive key of the epoch it was sent in, the current or the previous one
+// Frames whose counter is not above the last frame of their epoch are refused as replays
+func (k *sessionKeys) open(data []byte) ([]byte, error) {
+	if len(data) < frameHead {
+		return nil, errors.New("ciphertext too short")
+	}
+	epoch := binary.BigEndian.Uint32(data)
+	counter := binary.BigEndian.Uint64(data[epochSize:])
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var ciphers *epochCiphers
+	switch {
+	case epoch == k.epoch:
+		ciphers = k.current
+	case epoch+1 == k.epoch:
+		ciphers = k.previous
+	}
+	if ciphers == nil {
+		return nil, fmt.Errorf("frame sent with the key of unknown epoch %d", epoch)
+	}
+	if counter < ciphers.received {
+		return nil, fmt.Errorf("replayed frame %d of epoch %d", counter, epoch)
+	}
+
+	plaintext, err := ciphers.recv.Open(nil, counterNonce(counter, ciphers.recv), data[frameHead:], data[:frameHead])
+	if err != nil {
+		return nil, err
+	}
+	ciphers.received = counter + 1
+	return plaintext, nil
+}
+
+// Returns the nonce of the frame with the counter, the counter right aligned in zeros
+// Counters never repeat within an epoch and every epoch has new keys, so no nonce is used twice with a key
+func counterNonce(counter uint64, aead cipher.AEAD) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-counterSize:], counter)
+	return nonce
+}
+
+// Moves to the next epoch. The keys of the epoch before the previous one are forgotten
+func (k *sessionKeys) rotate(keys directionKeys) error {
+	ciphers, err := newEpochCiphers(keys)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.previous, k.current = k.current, ciphers
+	k.epoch++
+	return nil
+}
+
+// Starts a rekey and returns the public half of a new ephemeral key to send to the other side
+// Returns an empty string if a rekey is already waiting for an answer
+func (k *sessionKeys) startRekey() (string, error) {
+	priv, pub, err := newEphemeralKey()
+	if err != nil {
+		return "", err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.pending != nil {
+		return "", nil
+	}
+	k.pending = priv
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// Gives up on a rekey this side started that the other side refused, so the next one can start
+func (k *sessionKeys) cancelRekey() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pending = nil
+}
+
+// Finishes a rekey this side started, with the public half the other side answered with
+func (k *sessionKeys) finishRekey(peer string) error {
+	k.mu.Lock()
+	priv := k.pending
+	k.pending = nil
+	k.mu.Unlock()
+
+	if priv == nil {
+		return errors.New("rekey answer without a rekey")
+	}
+
+	keys, _, err := agreeKey(priv, peer, true)
+	if err != nil {
+		return err
+	}
+	return k.rotate(keys)
+}
+
+// Answers a rekey started by the other side. Returns the public half to send back and the keys of the next epoch
+// The answer has to be sent with the current keys, and rotate called only after it is written
+func answerRekey(peer string) (string, directionKeys, error) {
+	priv, pub, err := newEphemeralKey()
+	if err != nil {
+		return "", directionKeys{}, err
+	}
+
+	keys, _, err := agreeKey(priv, peer, false)
+	if err != nil {
+		return "", directionKeys{}, err
+	}
+	return base64.StdEncoding.EncodeToString(pub), keys, nil
+}
+
+// Generates an X25519 key that is used for a single key agreement and then dropped
+func newEphemeralKey() (priv []byte, pub []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, priv); err != nil {
+		return nil, nil, err
+	}
+
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+// Derives the session keys of both directions from an ephemeral private key and the public half of the other side
+// Both public halves go into the derivation in the same order on both sides, the side that started first
+// Also returns the decoded public half of the other side
+func agreeKey(priv []byte, peer string, initiator bool) (directionKeys, []byte, error) {
+	peerPub, err := base64.StdEncoding.DecodeString(peer)
+	if err != nil {
+		return directionKeys{}, nil, err
+	}
+	if len(peerPub) != curve25519.PointSize {
+		return directionKeys{}, nil, fmt.Errorf("ephemeral key has invalid length %d", len(peerPub))
+	}
+
+	// Fails for low order points, which would give a shared secret anyone could guess
+	shared, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return directionKeys{}, nil, err
+	}
+
+	ownPub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return directionKeys{}, nil, err
+	}
+
+	salt := append(append([]byte{}, ownPub...), peerPub...)
+	if !initiator {
+		salt = append(append([]byte{}, peerPub...), ownPub...)
+	}
+
+	initiatorKey, err := deriveKey(shared, salt, initiatorKeyInfo)
+	if err != nil {
+		return directionKeys{}, nil, err
+	}
+	responderKey, err := deriveKey(shared, salt, responderKeyInfo)
+	if err != nil {
+		return directionKeys{}, nil, err
+	}
+
+	if initiator {
+		return directionKeys{send: initiatorKey, recv: responderKey}, peerPub, nil
+	}
+	return directionKeys{send: responderKey, recv: initiatorKey}, peerPub, nil
+}
+
+// Derives one key from the shared secret with HKDF, the label picks which one
+func deriveKey(shared []byte, salt []byte, info string) ([]byte, error) {
+	key := make([]byte, sessionKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Signs both ephemeral keys of the handshake with the server identity key
+// The client checks the signature against the pinned server key, so nobody else can answer the key agreement
+func signHandshake(key *rsa.PrivateKey, clientPub []byte, serverPub []byte) (string, error) {
+	sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, handshakeDigest(clientPub, serverPub), nil)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// Checks the signature the server made over both ephemeral keys of the handshake
+func verifyHandshake(pub *rsa.PublicKey, clientPub []byte, serverPub []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	return rsa.VerifyPSS(pub, crypto.SHA256, handshakeDigest(clientPub, serverPub), sig, nil)
+}
+
+// Returns the hash the handshake signature is made over
+func handshakeDigest(clientPub []byte, serverPub []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(handshakeContext))
+	h.Write(clientPub)
+	h.Write(serverPub)
+	return h.Sum(nil)
+}
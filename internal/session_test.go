@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// Runs the key agreement both sides of a connection make and returns their session keys
+func agreedSessions(t *testing.T) (*sessionKeys, *sessionKeys) {
+	t.Helper()
+	clientPriv, clientPub, err := newEphemeralKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPriv, serverPub, err := newEphemeralKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKeys, _, err := agreeKey(clientPriv, base64.StdEncoding.EncodeToString(serverPub), true)
+	if err != nil {
+		t.Fatalf("agreeKey for the client: %v", err)
+	}
+	serverKeys, _, err := agreeKey(serverPriv, base64.StdEncoding.EncodeToString(clientPub), false)
+	if err != nil {
+		t.Fatalf("agreeKey for the server: %v", err)
+	}
+
+	clientSession, _ := newSessionKeys(clientKeys)
+	serverSession, _ := newSessionKeys(serverKeys)
+	return clientSession, serverSession
+}
+
+func TestSessionRefusesReplayedFrames(t *testing.T) {
+	clientSession, serverSession := agreedSessions(t)
+
+	once, _ := clientSession.seal([]byte("once"))
+	if msg, err := serverSession.open(once); err != nil || string(msg) != "once" {
+		t.Fatalf("open = %q, %v", msg, err)
+	}
+	if _, err := serverSession.open(once); err == nil {
+		t.Fatal("a replayed frame was opened")
+	}
+
+	// Frames that were never delivered can not be slipped in after later ones either
+	skipped, _ := clientSession.seal([]byte("skipped"))
+	later, _ := clientSession.seal([]byte("later"))
+	if _, err := serverSession.open(later); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := serverSession.open(skipped); err == nil {
+		t.Fatal("a frame with an older counter was opened")
+	}
+}
+
+func TestSessionRefusesReflectedFrames(t *testing.T) {
+	clientSession, serverSession := agreedSessions(t)
+
+	frame, _ := clientSession.seal([]byte("/kick bob"))
+	if _, err := clientSession.open(frame); err == nil {
+		t.Fatal("a frame was opened by the side that sealed it")
+	}
+	if _, err := serverSession.open(frame); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+}
+
+func TestSessionRekeyKeepsPreviousEpoch(t *testing.T) {
+	clientSession, serverSession := agreedSessions(t)
+
+	peer, err := clientSession.startRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, serverKeys, err := answerRekey(peer)
+	if err != nil {
+		t.Fatalf("answerRekey: %v", err)
+	}
+
+	// The server wrote this before it switched, the client reads it after
+	old, _ := serverSession.seal([]byte("old epoch"))
+	if err := serverSession.rotate(serverKeys); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientSession.finishRekey(answer); err != nil {
+		t.Fatalf("finishRekey: %v", err)
+	}
+
+	if msg, err := clientSession.open(old); err != nil || string(msg) != "old epoch" {
+		t.Fatalf("open of a frame of the previous epoch = %q, %v", msg, err)
+	}
+	if _, err := clientSession.open(old); err == nil {
+		t.Fatal("a frame of the previous epoch was opened twice")
+	}
+
+	frame, _ := clientSession.seal([]byte("new epoch"))
+	if msg, err := serverSession.open(frame); err != nil || string(msg) != "new epoch" {
+		t.Fatalf("open of a frame of the new epoch = %q, %v", msg, err)
+	}
+}
+
+func TestSessionRekeyAfterRefusal(t *testing.T) {
+	clientSession, _ := agreedSessions(t)
+
+	if peer, err := clientSession.startRekey(); err != nil || peer == "" {
+		t.Fatalf("startRekey = %q, %v", peer, err)
+	}
+	if peer, _ := clientSession.startRekey(); peer != "" {
+		t.Fatal("a second rekey started while the first waits for an answer")
+	}
+
+	// The server refused the rekey, the next one has to start anyway
+	clientSession.cancelRekey()
+	if peer, err := clientSession.startRekey(); err != nil || peer == "" {
+		t.Fatalf("startRekey after a refused rekey = %q, %v", peer, err)
+	}
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Settings for running the connection over TLS
+// The server serves TLS when a certificate is given, the client connects with TLS when Enabled is set
+type TLSOptions struct {
+	Enabled  bool   // client, connect over TLS
+	CertFile string // certificate of this side, PEM. Required on the server, only needed on the client for client certificate authentication
+	KeyFile  string // private key of the certificate, PEM
+
+	// Server: CA bundle client certificates are checked against, clients without a valid certificate are refused
+	// Client: CA bundle the server certificate is checked against instead of the system roots
+	CAFile string
+
+	InsecureSkipVerify bool // client, accept any server certificate. Only for local testing
+	SkipKeyExchange    bool // client, rely on TLS alone and skip the in-band key exchange
+}
+
+// Builds the TLS config of the server, nil when no certificate is given
+func ServerTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	if opts.CertFile == "" && opts.KeyFile == "" {
+		if opts.CAFile != "" {
+			return nil, errors.New("a client CA bundle needs a server certificate and key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// Client certificate authentication
+	if opts.CAFile != "" {
+		config.ClientCAs, err = loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Builds the TLS config the client connects to the address with, nil when TLS is not enabled
+// Skipping both the certificate check and the key exchange is refused
+func ClientTLSConfig(opts TLSOptions, addr string) (*tls.Config, error) {
+	if !opts.Enabled {
+		return nil, nil
+	}
+
+	// Without the certificate check and without the signed key exchange nothing proves who the server is
+	if opts.InsecureSkipVerify && opts.SkipKeyExchange {
+		return nil, errors.New("the key exchange can not be skipped while the server certificate is not verified")
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	// The certificate has to be issued for the host the client dials
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		config.ServerName = host
+	} else {
+		config.ServerName = "localhost"
+	}
+
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Reads a PEM bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s does not contain any certificates", path)
+	}
+	return pool, nil
+}
+
+// Checks whether the connection runs over TLS
+func isTLS(conn net.Conn) bool {
+	_, ok := conn.(*tls.Conn)
+	return ok
+}